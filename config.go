@@ -0,0 +1,158 @@
+package smartmeter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ModuleConfig はWi-SUNモジュールのフラッシュに保存しておく設定
+// ApplyConfig()で現在の仮想レジスタと比較し、異なる場合だけ書き込んでSKSAVEする
+// ゼロ値（nilや0、空文字列）のフィールドは変更しない
+type ModuleConfig struct {
+	Channel         int           // 論理チャンネル番号（S02）。0ならChannelとPANIDは変更しない
+	PANID           uint16        // PAN ID（S03）
+	PairingID       string        // ペアリングID（S0A）。空なら変更しない
+	BeaconResponse  *bool         // ビーコン応答フラグ（S15）。nilなら変更しない
+	SessionLifetime time.Duration // PANAセッションのライフタイム（S16）。0なら変更しない。S16は秒単位なので秒未満は切り捨てる
+	AutoReauth      *bool         // 自動再認証フラグ（S17）。nilなら変更しない
+	AutoLoad        *bool         // 起動時にSKSAVEした設定を自動で読み込むか（SFF）。nilなら変更しない
+}
+
+// Bool はModuleConfigのフラグに指定するためのポインタを返す
+func Bool(v bool) *bool {
+	return &v
+}
+
+// targets は設定で値を指定したレジスタを返す
+func (c *ModuleConfig) targets() (regs []Register) {
+	if c.Channel != 0 {
+		regs = append(regs, RegChannel, RegPANID)
+	}
+	if c.PairingID != "" {
+		regs = append(regs, RegPairingID)
+	}
+	if c.BeaconResponse != nil {
+		regs = append(regs, RegBeaconResponse)
+	}
+	if c.SessionLifetime != 0 {
+		regs = append(regs, RegSessionLifetime)
+	}
+	if c.AutoReauth != nil {
+		regs = append(regs, RegAutoReauth)
+	}
+	if c.AutoLoad != nil {
+		regs = append(regs, RegAutoLoad)
+	}
+	return
+}
+
+// Diff は現在のレジスタの値と比較し、書き換えが必要なレジスタを返す
+// regsは設定で値を指定したレジスタだけ読み出してあればよい
+func (c *ModuleConfig) Diff(regs *Registers) (diff []Register) {
+	for _, reg := range c.targets() {
+		var same bool
+		switch reg {
+		case RegChannel:
+			same = c.Channel == regs.Channel
+		case RegPANID:
+			same = c.PANID == regs.PANID
+		case RegPairingID:
+			same = c.PairingID == regs.PairingID
+		case RegBeaconResponse:
+			same = *c.BeaconResponse == regs.BeaconResponse
+		case RegSessionLifetime:
+			// SetSessionLifetime()と同じく秒未満を切り捨てて比較しないと、毎回書き換えることになる
+			same = c.SessionLifetime.Truncate(time.Second) == regs.SessionLifetime
+		case RegAutoReauth:
+			same = *c.AutoReauth == regs.AutoReauth
+		case RegAutoLoad:
+			same = *c.AutoLoad == regs.AutoLoad
+		}
+		if !same {
+			diff = append(diff, reg)
+		}
+	}
+	return
+}
+
+func (d *Device) setConfigRegister(ctx context.Context, c *ModuleConfig, reg Register, opts ...Option) error {
+	switch reg {
+	case RegChannel:
+		return d.SetChannelContext(ctx, c.Channel, opts...)
+	case RegPANID:
+		return d.SetPANIDContext(ctx, c.PANID, opts...)
+	case RegPairingID:
+		return d.SetPairingIDContext(ctx, c.PairingID, opts...)
+	case RegBeaconResponse:
+		return d.SetBeaconResponseContext(ctx, *c.BeaconResponse, opts...)
+	case RegSessionLifetime:
+		return d.SetSessionLifetimeContext(ctx, c.SessionLifetime, opts...)
+	case RegAutoReauth:
+		return d.SetAutoReauthContext(ctx, *c.AutoReauth, opts...)
+	case RegAutoLoad:
+		return d.setRegisterBool(ctx, RegAutoLoad, *c.AutoLoad, opts...)
+	default:
+		return fmt.Errorf("Register %s is not configurable by ModuleConfig", reg)
+	}
+}
+
+// ApplyConfig は設定の差分だけをモジュールに書き込んでSKSAVEする（ApplyConfigContext()を参照）
+func (d *Device) ApplyConfig(c *ModuleConfig, opts ...Option) (changed []Register, err error) {
+	return d.ApplyConfigContext(context.Background(), c, opts...)
+}
+
+// ApplyConfigContext は設定を現在のレジスタと比較し、差分だけを書き込んでSKSAVEする
+// 読み出すのは設定で値を指定したレジスタだけ。差分がなければフラッシュには書き込まない。書き換えたレジスタを返す
+func (d *Device) ApplyConfigContext(ctx context.Context, c *ModuleConfig, opts ...Option) (changed []Register, err error) {
+	regs := &Registers{}
+	for _, reg := range c.targets() {
+		if err = d.readRegister(ctx, reg, regs, opts...); err != nil {
+			return
+		}
+	}
+	diff := c.Diff(regs)
+	if len(diff) == 0 {
+		return
+	}
+	for _, reg := range diff {
+		if err = d.setConfigRegister(ctx, c, reg, opts...); err != nil {
+			return
+		}
+		changed = append(changed, reg)
+	}
+	err = d.SaveConfigContext(ctx, opts...)
+	return
+}
+
+func (d *Device) SaveConfig(opts ...Option) error {
+	return d.SaveConfigContext(context.Background(), opts...)
+}
+
+// SaveConfigContext は現在の仮想レジスタの内容をフラッシュに保存する（SKSAVE）
+// フラッシュの書き換え回数には上限があるので、なるべくApplyConfig()を使うこと
+func (d *Device) SaveConfigContext(ctx context.Context, opts ...Option) (err error) {
+	_, err = d.QuerySKCommandContext(ctx, "SKSAVE", opts...)
+	return
+}
+
+func (d *Device) LoadConfig(opts ...Option) error {
+	return d.LoadConfigContext(context.Background(), opts...)
+}
+
+// LoadConfigContext はフラッシュに保存した設定を仮想レジスタに読み込む（SKLOAD）
+// 保存された設定がなければER10のSKErrorが返る
+func (d *Device) LoadConfigContext(ctx context.Context, opts ...Option) (err error) {
+	_, err = d.QuerySKCommandContext(ctx, "SKLOAD", opts...)
+	return
+}
+
+func (d *Device) EraseConfig(opts ...Option) error {
+	return d.EraseConfigContext(context.Background(), opts...)
+}
+
+// EraseConfigContext はフラッシュに保存した設定を消去する（SKERASE）
+func (d *Device) EraseConfigContext(ctx context.Context, opts ...Option) (err error) {
+	_, err = d.QuerySKCommandContext(ctx, "SKERASE", opts...)
+	return
+}
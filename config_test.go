@@ -0,0 +1,112 @@
+package smartmeter_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestApplyConfig(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	cfg := &smartmeter.ModuleConfig{
+		Channel:         0x33,
+		PANID:           0x8888,
+		BeaconResponse:  smartmeter.Bool(true),
+		SessionLifetime: time.Hour,
+		AutoReauth:      smartmeter.Bool(true),
+		AutoLoad:        smartmeter.Bool(true),
+	}
+	changed, err := dev.ApplyConfig(cfg)
+	if err != nil {
+		t.Fatalf("ApplyConfig() error: %v", err)
+	}
+	expected := []smartmeter.Register{smartmeter.RegChannel, smartmeter.RegPANID, smartmeter.RegSessionLifetime, smartmeter.RegAutoReauth, smartmeter.RegAutoLoad}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Changed registers differ: %v != %v", changed, expected)
+	}
+	if n := countCommand(m, "SKSAVE"); n != 1 {
+		t.Errorf("SKSAVE should be sent once: %d", n)
+	}
+
+	// 設定が同じならフラッシュに書き込まない
+	changed, err = dev.ApplyConfig(cfg)
+	if err != nil || len(changed) != 0 {
+		t.Errorf("ApplyConfig() should be no-op: %v, %v", changed, err)
+	}
+	if n := countCommand(m, "SKSAVE"); n != 1 {
+		t.Errorf("SKSAVE should not be sent again: %d", n)
+	}
+
+	m.SetRegister("S02", "21")
+	if err := dev.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error: %v", err)
+	}
+	if ch, err := dev.GetChannel(); err != nil || ch != 0x33 {
+		t.Errorf("Channel should be restored: %X, %v", ch, err)
+	}
+
+	if err := dev.EraseConfig(); err != nil {
+		t.Fatalf("EraseConfig() error: %v", err)
+	}
+	var skErr *smartmeter.SKError
+	if err := dev.LoadConfig(); !errors.As(err, &skErr) || skErr.Code != smartmeter.ErrCodeExecFailed {
+		t.Errorf("LoadConfig() after erase should fail with ER10: %v", err)
+	}
+}
+
+func TestApplyPartialConfig(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.SetAutoReauth(true); err != nil {
+		t.Fatalf("SetAutoReauth() error: %v", err)
+	}
+	before := countCommand(m, "SKSREG")
+
+	// 指定していないフラグは変更せず、読み出しもしない
+	changed, err := dev.ApplyConfig(&smartmeter.ModuleConfig{PairingID: "C0FFEE00"})
+	if err != nil {
+		t.Fatalf("ApplyConfig() error: %v", err)
+	}
+	if !reflect.DeepEqual(changed, []smartmeter.Register{smartmeter.RegPairingID}) {
+		t.Errorf("Changed registers differ: %v != [S0A]", changed)
+	}
+	if n := countCommand(m, "SKSREG") - before; n != 2 {
+		t.Errorf("SKSREG count differ: %d != 2", n)
+	}
+	if v, err := dev.GetAutoReauth(); err != nil || !v {
+		t.Errorf("AutoReauth should be left unchanged: %v, %v", v, err)
+	}
+}
+
+func TestApplyConfigSubSecondLifetime(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	// S16は秒単位なので、秒未満の違いで書き換えを繰り返さない
+	c := &smartmeter.ModuleConfig{SessionLifetime: 90*time.Minute + 500*time.Millisecond}
+	if _, err := dev.ApplyConfig(c); err != nil {
+		t.Fatalf("ApplyConfig() error: %v", err)
+	}
+	changed, err := dev.ApplyConfig(c)
+	if err != nil {
+		t.Fatalf("ApplyConfig() error: %v", err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("Second ApplyConfig() should change nothing: %v", changed)
+	}
+	if n := countCommand(m, "SKSAVE"); n != 1 {
+		t.Errorf("SKSAVE count differ: %d != 1", n)
+	}
+}
@@ -2,63 +2,141 @@ package smartmeter
 
 import (
 	"bufio"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tarm/serial"
 )
 
 var (
-	reVersion        = regexp.MustCompile(`(?m)^EVER\s+(.*)$`)
-	reInfo           = regexp.MustCompile(`(?m)^EINFO\s+(.*)$`) // <IPADDR> + <ADDR64> + <CHANNEL> + <PANID> + <ADDR16>
-	reRegisterValue  = regexp.MustCompile(`(?m)^ESREG\s+(.*)$`)
-	rePanDesc        = regexp.MustCompile(`(?m)^EPANDESC$`)
-	rePanChannel     = regexp.MustCompile(`(?m)^\s+Channel:([23][0-9A-F])$`)
-	rePanID          = regexp.MustCompile(`(?m)^\s+Pan ID:(.*)$`)
-	rePanMacAddr     = regexp.MustCompile(`(?m)^\s+Addr:(.*)$`)
-	reIPAddr         = regexp.MustCompile(`(?m)^(?:[\dA-F]{4}:){7}[\dA-F]{4}$`)
-	reNeibour        = regexp.MustCompile(`(?m)^((?:[\dA-F]{4}:){7}[\dA-F]{4}) [\dA-F]{16} FFFF$`)
-	reEchonetLiteUDP = regexp.MustCompile(`(?m)^ERXUDP (?:[\dA-F]{4}:){7}[\dA-F]{4} (?:[\dA-F]{4}:){7}[\dA-F]{4} 0E1A 0E1A [\dA-F]{16} \d(?: \d+)? ([\dA-F]+) (.*)$`)
+	reVersion       = regexp.MustCompile(`(?m)^EVER\s+(.*)$`)
+	reAppVersion    = regexp.MustCompile(`(?m)^EAPPVER\s+(.*)$`)
+	reInfo          = regexp.MustCompile(`(?m)^EINFO\s+(.*)$`) // <IPADDR> + <ADDR64> + <CHANNEL> + <PANID> + <ADDR16> [+ <SIDE>]
+	reRegisterValue = regexp.MustCompile(`(?m)^ESREG\s+(.*)$`)
+	reIPAddr        = regexp.MustCompile(`(?m)^(?:[\dA-F]{4}:){7}[\dA-F]{4}$`)
 )
 
 // Device
+// Channel, IPAddrはScan()や自動再接続で書き換わる。他のgoroutineがDeviceを使っている間はSessionInfo()で読む
 type Device struct {
-	SerialPort  string
-	ID          string
-	Password    string
-	Channel     string
-	IPAddr      string
+	SerialPort string
+	ID         string
+	Password   string
+	Channel    string
+	IPAddr     string
+	// DualStackSK はOpen()時にデュアルスタックモジュールとして扱ったか。変更しても効果はない
+	// DualStackSK()かProfile()オプションで指定した値か、自動判別の結果が入る
+	// SKSCANやSKSENDTOのFAIL ER05でModuleProfileを切り替えた後の書式はProfile()で参照する
 	DualStackSK bool
 	Verbosity   int
 
+	store           SessionStore
+	panSelector     PANSelector
+	scanDurations   []int
+	scanChannelMask uint32
+	scanBudget      time.Duration
+	scanProgress    func(ScanProgress)
+	reauthPolicy    ReauthPolicy
+	reauthMu        sync.Mutex
+	waitLimit       bool
+	wantDisplay     *DisplayMode // Display()で指定した表示形式。nilならモジュールの設定に従う
+	readTimeout     time.Duration
+
 	panID     string
 	macAddr   string
 	logger    *log.Logger
 	options   []Option
 	inputChan chan string
 	writer    *bufio.Writer
+	port      io.ReadWriteCloser
+	sem       chan struct{} // SKコマンドの実行権（同時に1クエリだけが保持する）
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{} // 読み込みが終了したらcloseされる
+
+	mu            sync.Mutex
+	readErr       error
+	active        *inbox        // 実行中のクエリへの入力
+	detached      chan struct{} // 実行中のクエリが終わったらcloseされる
+	session       SessionState
+	joins         int
+	limited       bool
+	limitReleased chan struct{}
+	subscribers   []*subscriber
+	lqis          []int // 直近の受信ED値（リングバッファ）
+	lqiNext       int
+	lqiLast       int
+	lqiUpdated    time.Time
+	tcpPorts      int          // DialTCP()で使ったローカルポートの数
+	tcpHandles    map[int]bool // 確立済みのTCP接続のハンドル
+	display       DisplayMode
+	profile       ModuleProfile
+	altProfile    ModuleProfile // 自動判別で選ばなかった、SIDEの有無だけが逆のModuleProfile
 }
 
 func Open(path string, opts ...Option) (d *Device, err error) {
+	return OpenContext(context.Background(), path, opts...)
+}
+
+// defaultReadTimeout はOpen()で開くシリアルポートの読み込みタイムアウト
+// tarm/serialのポートはブロッキングモードなので、Close()しても読み込み中のRead()は返らない
+// タイムアウトで定期的にRead()から戻り、Close()されたことに気付けるようにする
+const defaultReadTimeout = 100 * time.Millisecond
+
+// OpenContext はシリアルポートを開いてDeviceを返す
+// 通信設定は115200bps 8N1、読み込みタイムアウトは100msがデフォルトで、BaudRate(), Parity(), ReadTimeout()で変更できる
+// ReadTimeout(0)を指定すると、Close()後もモジュールから次の1バイトが届くまで読み込み用goroutineとポートが残る
+// モジュールとのやり取り（NewDeviceContext()を参照）はctxがキャンセルされると中断する
+func OpenContext(ctx context.Context, path string, opts ...Option) (d *Device, err error) {
+	opts = append([]Option{ReadTimeout(defaultReadTimeout)}, opts...)
 	c := &serial.Config{
 		Name:     path,
 		Baud:     115200,
 		Size:     8,
 		StopBits: 1,
 	}
+	for _, opt := range opts {
+		if err = opt(c); err != nil {
+			return
+		}
+	}
 	sr, err := serial.OpenPort(c)
 	if err != nil {
 		return
 	}
 
+	d, err = NewDeviceContext(ctx, sr, opts...)
+	if err != nil {
+		sr.Close()
+		return
+	}
+	d.SerialPort = path
+	return
+}
+
+func NewDevice(rw io.ReadWriteCloser, opts ...Option) (d *Device, err error) {
+	return NewDeviceContext(context.Background(), rw, opts...)
+}
+
+// NewDeviceContext は任意のio.ReadWriteCloserをWi-SUNモジュールとの通信路としてDeviceを返す
+// ptyやser2netのTCPソケット、テスト用のパイプなどを利用できる
+// Profile()かDualStackSK()を指定しなければSKVER, SKAPPVER, SKINFOでモジュールを判別し、
+// WOPT/ROPTに対応したモジュールならROPTで表示形式を調べる。これらのやり取りはctxがキャンセルされると中断する
+func NewDeviceContext(ctx context.Context, rw io.ReadWriteCloser, opts ...Option) (d *Device, err error) {
 	d = &Device{
 		options: opts,
-		writer:  bufio.NewWriter(sr),
+		writer:  bufio.NewWriter(rw),
+		port:    rw,
+		sem:     make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 	for _, opt := range opts {
 		if err := opt(d); err != nil {
@@ -66,44 +144,182 @@ func Open(path string, opts ...Option) (d *Device, err error) {
 		}
 	}
 
-	scanner := bufio.NewScanner(sr)
-	ch := make(chan string, 4)
+	var r *bufio.Reader
+	if d.readTimeout > 0 {
+		r = bufio.NewReader(&idleReader{r: rw, closed: d.closed})
+	} else {
+		r = bufio.NewReader(rw)
+	}
+	ch := make(chan string, 64)
 	d.inputChan = ch
 
-	go func() {
+	// 初期化に失敗するとdはnilで返るので、goroutineには引数で渡す
+	go func(d *Device) {
 		defer close(ch)
-		defer sr.Close()
+		defer rw.Close()
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			ch <- line
-		}
-		/*
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
+		for {
+			line, err := d.readLine(r)
+			if err != nil {
+				// 読み込みエラー（デバイスの抜去やEOF）は保存して以降のコマンドで返す
+				d.setReadError(err)
+				return
+			}
+			select {
+			case ch <- line:
+			case <-d.closed:
+				return
 			}
-		*/
-	}()
+		}
+	}(d)
+
+	// 受信した行を実行中のクエリと購読者に振り分ける
+	go func(d *Device) {
+		defer close(d.done)
+		for line := range ch {
+			d.dispatch(line)
+		}
+	}(d)
+
+	// コマンドの書式はモジュールによって違うので、指定がなければSKVERなどから判別する
+	if d.Profile() == nil {
+		if err = d.detectProfile(ctx); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	// 表示形式が分からないとERXUDPやERXTCPのデータ部を解釈できないので、最初に揃えておく
+	if err = d.negotiateDisplayMode(ctx); err != nil {
+		d.Close()
+		return nil, err
+	}
+	// 起動前から送信総和時間の制限中だとEVENT 32は届かないので、SFBで確認しておく
+	if _, err = d.syncTransmitLimit(ctx); err != nil {
+		if ctx.Err() != nil {
+			d.Close()
+			return nil, err
+		}
+		d.warnf("Failed to read transmission time limit flag: %+v", err)
+		err = nil
+	}
+	return
+}
+
+// idleReader は読み込みタイムアウトで返る(0, io.EOF)をデータなしとみなして読み直す
+// tarm/serialはReadTimeout()を指定すると、タイムアウトまでに何も届かなければ(0, io.EOF)を返す
+type idleReader struct {
+	r      io.Reader
+	closed <-chan struct{}
+}
+
+func (r *idleReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = r.r.Read(p)
+		if n > 0 || err != io.EOF {
+			return
+		}
+		select {
+		case <-r.closed:
+			return
+		default:
+		}
+	}
+}
 
+// Close は読み込み用goroutineを停止し、シリアルポートを閉じる
+// 実行中のクエリはErrClosedを返して終了する
+// NewDevice()に渡したio.ReadWriteCloserが、Close()で読み込み中のRead()を中断できない場合は、
+// 次にRead()から戻るまで読み込み用goroutineが残る（Open()ではReadTimeout()の間隔で戻る）
+func (d *Device) Close() (err error) {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		err = d.port.Close()
+	})
 	return
 }
 
-func (d *Device) GetVersion(opts ...Option) (version string, err error) {
-	res, err := d.QuerySKCommand("SKVER", opts...)
+// acquire はSKコマンドの実行権を得る。他のクエリが実行中ならその終了まで待つ
+// 実行権を持つクエリだけがコマンドを書き込み、レスポンスを読むことができる
+func (d *Device) acquire(ctx context.Context) error {
+	select {
+	case d.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.closed:
+		return ErrClosed
+	}
+}
+
+func (d *Device) release() {
+	<-d.sem
+}
+
+func (d *Device) setReadError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.closed:
+		// Close()によるエラーは記録しない
+	default:
+		d.readErr = err
+	}
+}
+
+// err はDeviceが利用できない場合にその理由を返す
+func (d *Device) err() error {
+	select {
+	case <-d.closed:
+		return ErrClosed
+	default:
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.readErr != nil {
+		return &ReadError{Err: d.readErr}
+	}
+	return nil
+}
+
+func (d *Device) GetVersion(opts ...Option) (version ModuleVersion, err error) {
+	return d.GetVersionContext(context.Background(), opts...)
+}
+
+// GetVersionContext はSKVERとSKAPPVERでファームウェアのバージョンを取得する
+// SKAPPVERに対応していないモジュールではAppが空になる
+func (d *Device) GetVersionContext(ctx context.Context, opts ...Option) (version ModuleVersion, err error) {
+	res, err := d.QuerySKCommandContext(ctx, "SKVER", opts...)
 	if err != nil {
 		return
 	}
 	matched := reVersion.FindStringSubmatch(res)
 	if len(matched) == 0 {
 		err = fmt.Errorf("Unexpected response for SKVER: %s", res)
-	} else {
-		version = matched[1]
+		return
+	}
+	if version, err = parseModuleVersion(matched[1]); err != nil {
+		return
+	}
+
+	res, err = d.QuerySKCommandContext(ctx, "SKAPPVER", opts...)
+	var skErr *SKError
+	if errors.As(err, &skErr) {
+		return version, nil
+	} else if err != nil {
+		return
+	}
+	if matched := reAppVersion.FindStringSubmatch(res); len(matched) > 0 {
+		version.App = matched[1]
 	}
 	return
 }
 
-func (d *Device) GetInfo(opts ...Option) (info string, err error) {
-	res, err := d.QuerySKCommand("SKINFO", opts...)
+func (d *Device) GetInfo(opts ...Option) (info ModuleInfo, err error) {
+	return d.GetInfoContext(context.Background(), opts...)
+}
+
+func (d *Device) GetInfoContext(ctx context.Context, opts ...Option) (info ModuleInfo, err error) {
+	res, err := d.QuerySKCommandContext(ctx, "SKINFO", opts...)
 	if err != nil {
 		return
 	}
@@ -111,16 +327,20 @@ func (d *Device) GetInfo(opts ...Option) (info string, err error) {
 	if len(matched) == 0 {
 		err = fmt.Errorf("Unexpected response for SKINFO: %s", res)
 	} else {
-		info = matched[1]
+		info, err = parseModuleInfo(matched[1])
 	}
 	return
 }
 
 func (d *Device) GetRegisterValue(regName string, opts ...Option) (registerValue string, err error) {
+	return d.GetRegisterValueContext(context.Background(), regName, opts...)
+}
+
+func (d *Device) GetRegisterValueContext(ctx context.Context, regName string, opts ...Option) (registerValue string, err error) {
 	if !strings.HasPrefix(regName, "S") {
 		return "", fmt.Errorf("Invalid register name: %s", regName)
 	}
-	res, err := d.QuerySKCommand("SKSREG "+regName, opts...)
+	res, err := d.QuerySKCommandContext(ctx, "SKSREG "+regName, opts...)
 	if err != nil {
 		return
 	}
@@ -134,52 +354,68 @@ func (d *Device) GetRegisterValue(regName string, opts ...Option) (registerValue
 }
 
 func (d *Device) SetRegisterValue(regName string, regValue string, opts ...Option) (err error) {
+	return d.SetRegisterValueContext(context.Background(), regName, regValue, opts...)
+}
+
+func (d *Device) SetRegisterValueContext(ctx context.Context, regName string, regValue string, opts ...Option) (err error) {
 	if !strings.HasPrefix(regName, "S") {
 		return fmt.Errorf("Invalid register name: %s", regName)
 	}
 	cmd := fmt.Sprintf("SKSREG %s %s", regName, regValue)
-	_, err = d.QuerySKCommand(cmd, opts...)
+	_, err = d.QuerySKCommandContext(ctx, cmd, opts...)
 	return
 }
 
 func (d *Device) SetID(opts ...Option) (err error) {
+	return d.SetIDContext(context.Background(), opts...)
+}
+
+func (d *Device) SetIDContext(ctx context.Context, opts ...Option) (err error) {
 	if d.ID == "" {
 		return errors.New("ID not specifed")
 	}
-	_, err = d.QuerySKCommand("SKSETRBID "+d.ID, opts...)
+	_, err = d.QuerySKCommandContext(ctx, "SKSETRBID "+d.ID, opts...)
 	return
 }
 
 func (d *Device) SetPassword(opts ...Option) (err error) {
+	return d.SetPasswordContext(context.Background(), opts...)
+}
+
+func (d *Device) SetPasswordContext(ctx context.Context, opts ...Option) (err error) {
 	if d.Password == "" {
 		return errors.New("Password not specifed")
 	}
 	cmd := fmt.Sprintf("SKSETPWD %X %s", len(d.Password), d.Password)
-	_, err = d.QuerySKCommand(cmd, opts...)
+	_, err = d.QuerySKCommandContext(ctx, cmd, opts...)
 	return
 }
 
 func (d *Device) GetNeibourIP(opts ...Option) (ipAddr string, err error) {
-	res, err := d.QuerySKCommand("SKTABLE 2", opts...)
+	return d.GetNeibourIPContext(context.Background(), opts...)
+}
+
+// GetNeibourIPContext はネイバーキャッシュに1台だけ登録されている相手のIPv6アドレスを返す
+func (d *Device) GetNeibourIPContext(ctx context.Context, opts ...Option) (ipAddr string, err error) {
+	entries, err := d.NeighborTableContext(ctx, opts...)
 	if err != nil {
 		return
 	}
-	matched := reNeibour.FindAllStringSubmatch(res, -1)
-	if len(matched) != 1 {
-		err = fmt.Errorf("Unexpected response for SKSREG: %s", res)
+	if len(entries) != 1 {
+		err = fmt.Errorf("Unexpected number of neighbors in SKTABLE 2: %d", len(entries))
 	} else {
-		ipAddr = matched[0][1]
+		ipAddr = formatIPv6(entries[0].IPAddr)
 	}
 	return
 }
 
-func (d *Device) getIPAddrFromMacAddr(opts ...Option) (ipAddr string, err error) {
+func (d *Device) getIPAddrFromMacAddr(ctx context.Context, macAddr string, opts ...Option) (ipAddr string, err error) {
 	callback := func(line string) (bool, error) {
 		// SKLL64コマンドだけはOKを返さず、直後の1行がレスポンス
 		return true, nil
 	}
 	skll64Opts := append([]Option{Reader(callback)}, opts...)
-	res, err := d.QuerySKCommand("SKLL64 "+d.macAddr, skll64Opts...)
+	res, err := d.QuerySKCommandContext(ctx, "SKLL64 "+macAddr, skll64Opts...)
 	ipAddr = reIPAddr.FindString(res)
 	if ipAddr == "" {
 		err = fmt.Errorf(`IP address is invalid: %q`, res)
@@ -187,108 +423,192 @@ func (d *Device) getIPAddrFromMacAddr(opts ...Option) (ipAddr string, err error)
 	return
 }
 
-func (d *Device) Scan(opts ...Option) (err error) {
-	if err = d.SetID(); err != nil {
+func (d *Device) Scan(opts ...Option) (pans []PANDescriptor, err error) {
+	return d.ScanContext(context.Background(), opts...)
+}
+
+// ScanContext はアクティブスキャンで見つかった全てのPANを返す
+// 見つかったPANからSelectPAN()で指定した方法で接続先を選び、Channel, IPAddrなどを設定する
+func (d *Device) ScanContext(ctx context.Context, opts ...Option) (pans []PANDescriptor, err error) {
+	if err = d.SetIDContext(ctx); err != nil {
 		return
 	}
-	if err = d.SetPassword(); err != nil {
+	if err = d.SetPasswordContext(ctx); err != nil {
 		return
 	}
 
-	var mask uint32
-	mask = 0xffffffff
-	if d.Channel != "" {
-		var i int64
-		i, err = strconv.ParseInt(d.Channel, 16, 0)
+	mask, err := d.scanMask()
+	if err != nil {
+		return
+	}
+	durations := d.scanDurations
+	if len(durations) == 0 {
+		durations = defaultScanDurations
+	}
+	scanCtx := ctx
+	if d.scanBudget > 0 {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithTimeout(ctx, d.scanBudget)
+		defer cancel()
+	}
+
+	// 短いスキャン時間から始めて、PANが見つかるまでスキャン時間を延ばしていく
+	// ScanBudget()を指定した場合は、予算を使い切るまで最後のスキャン時間で繰り返す
+	var timedOut error
+	for pass := 1; ; pass++ {
+		i := pass - 1
+		if i >= len(durations) {
+			if d.scanBudget <= 0 {
+				break
+			}
+			i = len(durations) - 1
+		}
+		pans, err = d.activeScan(scanCtx, mask, durations[i], pass, opts...)
+		if errors.Is(err, ErrTimeout) && scanCtx.Err() == nil {
+			// 1回のスキャンがタイムアウトしても、このスキャン時間ではPANが見つからなかったものとして次に進む
+			d.warnf("Scan pass %d (duration %d) timed out: %+v", pass, durations[i], err)
+			timedOut = fmt.Errorf("scan pass %d (duration %d) timed out: %v", pass, durations[i], err)
+			pans, err = nil, nil
+			continue
+		}
 		if err != nil {
-			err = fmt.Errorf(`Specified channel is invalid: "%s"`, d.Channel)
-			return
-		} else if i < 33 || i > 60 {
-			err = fmt.Errorf(`Channel must be 21-3C: "%s"`, d.Channel)
+			if ctx.Err() == nil && scanCtx.Err() != nil {
+				err = fmt.Errorf("%w (scan budget %v exhausted)", ErrPANNotFound, d.scanBudget)
+			}
 			return
 		}
-		mask = 1 << (i - 33)
-	}
-	cmd := fmt.Sprintf("SKSCAN 2 %08X 7", mask)
-	if d.DualStackSK {
-		cmd = cmd + " 0"
-	}
-
-	callback := func(line string) (bool, error) {
-		if strings.HasPrefix(line, "EVENT 22 ") {
-			// EVENT 22: アクティブスキャン完了
-			return true, nil
+		if len(pans) > 0 {
+			break
 		}
-		return false, nil
 	}
-	skscanOpts := append([]Option{Reader(callback)}, opts...)
-	res, err := d.QuerySKCommand(cmd, skscanOpts...)
-	if err != nil {
-		return
-	}
-	if !rePanDesc.MatchString(res) {
-		err = fmt.Errorf(`Scan failed. Response is: "%s"`, res)
+	if len(pans) == 0 {
+		err = ErrPANNotFound
+		if timedOut != nil {
+			// タイムアウトしたスキャンがあれば、見つからなかった原因の手がかりとして添える
+			err = fmt.Errorf("%w (last %v)", ErrPANNotFound, timedOut)
+		}
 		return
 	}
-
-	channel := rePanChannel.FindStringSubmatch(res)[1]
-	panID := rePanID.FindStringSubmatch(res)[1]
-	macAddr := rePanMacAddr.FindStringSubmatch(res)[1]
-	if channel == "" || panID == "" || macAddr == "" {
-		err = fmt.Errorf(`Channel or PAN ID or MAC address is invalid: "%s", "%s", "%s"`, channel, panID, macAddr)
+	pan, err := d.selectPAN(pans)
+	if err != nil {
 		return
 	}
-	d.Channel = channel
-	d.panID = panID
-	d.macAddr = macAddr
+	d.infof("PAN selected: %s", pan)
+	d.recordLinkQuality(pan.LQI, time.Now())
+	macAddr := fmt.Sprintf("%X", []byte(pan.MACAddr))
+	d.updateTarget(func(t *SessionInfo) {
+		t.Channel = fmt.Sprintf("%02X", pan.Channel)
+		t.PanID = fmt.Sprintf("%04X", pan.PanID)
+		t.MACAddr = macAddr
+	})
 
-	ipAddr, err := d.getIPAddrFromMacAddr(opts...)
+	ipAddr, err := d.getIPAddrFromMacAddr(ctx, macAddr, opts...)
 	if err != nil {
 		return
 	}
-	d.IPAddr = ipAddr
+	d.updateTarget(func(t *SessionInfo) {
+		t.IPAddr = ipAddr
+	})
 	return
 }
 
 func (d *Device) Join(opts ...Option) (err error) {
-	callback := func(line string) (bool, error) {
-		if strings.HasPrefix(line, "EVENT 24 ") {
-			// EVENT 24: PANAによる接続過程でエラーが発生した
+	return d.JoinContext(context.Background(), opts...)
+}
+
+func (d *Device) JoinContext(ctx context.Context, opts ...Option) (err error) {
+	joinOpts := append([]Option{Reader(d.joinReader)}, opts...)
+	_, err = d.QuerySKCommandContext(ctx, "SKJOIN "+d.SessionInfo().IPAddr, joinOpts...)
+	return
+}
+
+func (d *Device) Rejoin(opts ...Option) (err error) {
+	return d.RejoinContext(context.Background(), opts...)
+}
+
+// RejoinContext は現在接続しているPAAに対してPANA認証をやり直す（SKREJOIN）
+// 一度もJoinしていない、またはSKTERMやSKRESETの後はER10のSKErrorが返る
+func (d *Device) RejoinContext(ctx context.Context, opts ...Option) (err error) {
+	joinOpts := append([]Option{Reader(d.joinReader)}, opts...)
+	_, err = d.QuerySKCommandContext(ctx, "SKREJOIN", joinOpts...)
+	return
+}
+
+// joinReader はSKJOINとSKREJOINのレスポンスをEVENT 25まで読む
+func (d *Device) joinReader(line string) (bool, error) {
+	if ev, ok := d.lineEvent(line); ok {
+		switch ev.Code {
+		case EventPANAFailed:
 			return false, fmt.Errorf("PANA connection error (%s). %w", line, RetryableError)
-		} else if strings.HasPrefix(line, "EVENT 25 ") {
-			// EVENT 25: PANAによる接続が完了した（Join成功）
+		case EventPANAConnected:
+			// Join成功
 			return true, nil
 		}
-		return false, nil
 	}
-	joinOpts := append([]Option{Reader(callback)}, opts...)
-	_, err = d.QuerySKCommand("SKJOIN "+d.IPAddr, joinOpts...)
-	return
+	return false, nil
 }
 
 func (d *Device) Authenticate(opts ...Option) (err error) {
-	err = d.Scan(opts...)
+	return d.AuthenticateContext(context.Background(), opts...)
+}
+
+// AuthenticateContext はスキャンしてスマートメーターを探し、PANAで接続する
+// Store()を指定した場合は、保存された接続先に直接Joinを試み、失敗したときだけスキャンする
+func (d *Device) AuthenticateContext(ctx context.Context, opts ...Option) (err error) {
+	if d.store != nil {
+		channel := d.SessionInfo().Channel
+		if err = d.joinCached(ctx, opts...); err == nil || ctx.Err() != nil {
+			return
+		}
+		d.warnf("Join with cached session failed, scanning again: %+v", err)
+		// 保存されていたチャンネルではなく、元の指定に従ってスキャンする
+		d.updateTarget(func(t *SessionInfo) {
+			t.Channel = channel
+		})
+	}
+
+	_, err = d.ScanContext(ctx, opts...)
 	if err != nil {
 		return
 	}
 
-	if err = d.SetRegisterValue("S02", d.Channel, opts...); err != nil {
+	target := d.SessionInfo()
+	if err = d.SetRegisterValueContext(ctx, "S02", target.Channel, opts...); err != nil {
 		return
 	}
 
-	if err = d.SetRegisterValue("S03", d.panID, opts...); err != nil {
+	if err = d.SetRegisterValueContext(ctx, "S03", target.PanID, opts...); err != nil {
+		return
+	}
+	if err = d.JoinContext(ctx, opts...); err != nil {
 		return
 	}
-	return d.Join(opts...)
+	if d.store != nil {
+		d.saveSession()
+	}
+	return
 }
 
 func (d *Device) QuerySKCommand(cmd string, opts ...Option) (res string, err error) {
-	query, err := NewSKQuery(d, cmd, append(d.options, opts...)...)
+	return d.QuerySKCommandContext(context.Background(), cmd, opts...)
+}
+
+// QuerySKCommandContext はSKコマンドを送信してレスポンスを返す
+// ctxがキャンセルされるかデッドラインを過ぎると、レスポンス待ちやリトライ待ちを中断してctx.Err()を返す
+func (d *Device) QuerySKCommandContext(ctx context.Context, cmd string, opts ...Option) (res string, err error) {
+	return d.querySKCommandContext(ctx, cmd, nil, opts...)
+}
+
+// querySKCommandContext はDeviceのオプション, overrides, optsの順に適用してSKコマンドを実行する
+// overridesにはDeviceの指定を踏まえて決めた、コマンドごとの値（スキャンのタイムアウトなど）を渡す
+func (d *Device) querySKCommandContext(ctx context.Context, cmd string, overrides []Option, opts ...Option) (res string, err error) {
+	all := append(append(append([]Option{}, d.options...), overrides...), opts...)
+	query, err := NewSKQuery(d, cmd, all...)
 	if err != nil {
 		d.warnf("Error for SK command %q: %+v", cmd, err)
 		return
 	}
-	res, err = query.Exec()
+	res, err = query.ExecContext(ctx)
 	if err != nil {
 		d.warnf("Error for SK command %q: %+v", cmd, err)
 	}
@@ -296,35 +616,58 @@ func (d *Device) QuerySKCommand(cmd string, opts ...Option) (res string, err err
 }
 
 func (d *Device) QueryEchonetLite(req *Frame, opts ...Option) (res *Frame, err error) {
-	secure := 1
-	port := 3610
-	side := 0 // 0: B-route, 1: HAN
+	return d.QueryEchonetLiteContext(context.Background(), req, opts...)
+}
+
+// QueryEchonetLiteContext はスマートメーターにECHONET Liteの要求を送り、対応する応答を返す
+// AutoReauth()を指定した場合、PANAセッションが切れていれば再接続してから要求を送り直す
+// 送信総和時間の制限中はErrTransmitLimitedを返す。WaitTransmitLimit(true)を指定した場合は解除まで待つ
+func (d *Device) QueryEchonetLiteContext(ctx context.Context, req *Frame, opts ...Option) (res *Frame, err error) {
+	joins := d.joinCount()
+	if d.sessionLost(nil) {
+		if err = d.reauthenticate(ctx, joins, opts...); err != nil {
+			return
+		}
+		joins = d.joinCount()
+	}
+	res, err = d.queryEchonetLite(ctx, req, opts...)
+	if errors.Is(err, ErrTransmitLimited) && d.waitLimit {
+		// 送信総和時間の制限が解除されたら送り直す
+		if err = d.waitTransmitLimit(ctx); err != nil {
+			return
+		}
+		res, err = d.queryEchonetLite(ctx, req, opts...)
+	}
+	if err != nil && ctx.Err() == nil && d.sessionLost(err) {
+		if err = d.reauthenticate(ctx, joins, opts...); err != nil {
+			return
+		}
+		res, err = d.queryEchonetLite(ctx, req, opts...)
+	}
+	return
+}
 
-	if d.IPAddr == "" {
+func (d *Device) queryEchonetLite(ctx context.Context, req *Frame, opts ...Option) (res *Frame, err error) {
+	ipAddr := d.SessionInfo().IPAddr
+	if ipAddr == "" {
 		err = errors.New("IP address for smart electric energy meter is not specifed")
 		return
 	}
+	if err = d.waitTransmitLimit(ctx); err != nil {
+		return
+	}
 
 	rawFrame := req.Build()
-	var cmd string
-	if d.DualStackSK {
-		cmd = fmt.Sprintf("SKSENDTO %d %s %04X %d %d %04X %s", secure, d.IPAddr, port, secure, side, len(rawFrame), rawFrame)
-	} else {
-		cmd = fmt.Sprintf("SKSENDTO %d %s %04X %d %04X %s", secure, d.IPAddr, port, secure, len(rawFrame), rawFrame)
-	}
+	profile := d.Profile()
+	cmd := sendToCommand(profile, echonetLiteHandle, ipAddr, 3610, true, 0, rawFrame)
 
 	callback := func(line string) (bool, error) {
-		if strings.HasPrefix(line, "EVENT 21 ") {
-			// EVENT 21: UDP送信完了
-			if strings.HasSuffix(line, " 01") {
-				// 01: UDP送信失敗
-				return false, fmt.Errorf("Failed to send UDP packet (EVENT 21/01). %w", RetryableError)
-			} else if strings.HasSuffix(line, " 02") {
-				// 02: アドレス要請
-				return false, fmt.Errorf("PANA unconnected (EVENT 21/02)")
+		if ev, ok := d.lineEvent(line); ok {
+			if err := udpSentError(ev); err != nil {
+				return false, err
 			}
 		} else if strings.HasPrefix(line, "ERXUDP ") {
-			f, err := parseERXUDP(line)
+			f, err := d.parseERXUDP(line)
 			if err != nil {
 				d.warnf("ERXUDP parse error: cmd=%q, err=%+v", cmd, err)
 			} else if !f.CorrespondTo(req) {
@@ -337,41 +680,30 @@ func (d *Device) QueryEchonetLite(req *Frame, opts ...Option) (res *Frame, err e
 		return false, nil
 	}
 	echonetLiteOpts := append([]Option{Reader(callback)}, opts...)
-	_, err = d.QuerySKCommand(cmd, echonetLiteOpts...)
+	_, err = d.QuerySKCommandContext(ctx, cmd, echonetLiteOpts...)
+	if d.fallbackProfile(profile, err) {
+		cmd = sendToCommand(d.Profile(), echonetLiteHandle, ipAddr, 3610, true, 0, rawFrame)
+		_, err = d.QuerySKCommandContext(ctx, cmd, echonetLiteOpts...)
+	}
+	err = d.sendToError(ctx, err, opts...)
 	return
 }
 
-// ERXUDPイベント行を受け取ってFrameを返す
+// ERXUDPイベント行をModuleProfileの書式で解釈してFrameを返す
 // ECHONET Liteのフレームのみ処理する
-func parseERXUDP(line string) (res *Frame, err error) {
-	matched := reEchonetLiteUDP.FindStringSubmatch(line)
-	if len(matched) == 0 {
-		err = fmt.Errorf("Unknown ERXUDP format: %s", line)
-		return
-	}
-
-	dataLen, err := strconv.ParseInt(matched[1], 16, 32)
+func (d *Device) parseERXUDP(line string) (res *Frame, err error) {
+	p, err := d.Profile().ParseUDP(line, d.DisplayMode())
 	if err != nil {
-		err = errors.New("ERXUDP parse error (not a number) : " + line)
 		return
 	}
-	data := matched[2]
-	var rawData []byte
-	if len(data) == int(dataLen) {
-		// WOPT 0（バイナリ）
-		rawData = []byte(data)
-	} else if len(data) == int(2*dataLen) {
-		// WOPT 1（16進ASCII）
-		rawData, err = hex.DecodeString(data)
-		if err != nil {
-			err = errors.New("ERXUDP parse error (not a hexadecimal) : " + line)
-			return
-		}
-	} else {
-		err = errors.New("ERXUDP data length mismatch: " + line)
+	if p.SrcPort != 3610 || p.DstPort != 3610 {
+		err = fmt.Errorf("Not an ECHONET Lite packet: %s", line)
 		return
 	}
-	return ParseFrame(rawData)
+	if res, err = ParseFrame(p.Data); err == nil {
+		res.Packet = p
+	}
+	return
 }
 
 func (d *Device) warnf(fmt string, v ...interface{}) {
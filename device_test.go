@@ -0,0 +1,618 @@
+package smartmeter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func newTestDevice(t *testing.T, m *sktest.Module, opts ...smartmeter.Option) *smartmeter.Device {
+	t.Helper()
+	opts = append([]smartmeter.Option{
+		smartmeter.ID(m.Meter.ID),
+		smartmeter.Password(m.Meter.Password),
+		smartmeter.DualStackSK(m.DualStack),
+		smartmeter.RetryInterval(10 * time.Millisecond),
+		smartmeter.Timeout(time.Second),
+	}, opts...)
+	dev, err := smartmeter.NewDevice(m, opts...)
+	if err != nil {
+		t.Fatalf("NewDevice() error: %v", err)
+	}
+	return dev
+}
+
+func newInstantaneousPowerRequest() *smartmeter.Frame {
+	return smartmeter.NewFrame(smartmeter.LvSmartElectricEnergyMeter, smartmeter.Get, []*smartmeter.Property{
+		smartmeter.NewProperty(smartmeter.LvSmartElectricEnergyMeter_InstantaneousElectricPower, nil),
+	})
+}
+
+func TestGetVersion(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	version, err := dev.GetVersion()
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	expected := smartmeter.ModuleVersion{Major: 1, Minor: 2, Patch: 10, App: "rev26e"}
+	if version != expected {
+		t.Errorf("Version differ: %+v != %+v", version, expected)
+	}
+	if !version.AtLeast(1, 2, 8) || version.AtLeast(1, 3, 0) {
+		t.Errorf("AtLeast() returned wrong result for %s", version)
+	}
+
+	m = sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	m.AppVersion = ""
+	defer m.Close()
+	version, err = newTestDevice(t, m).GetVersion()
+	if err != nil {
+		t.Fatalf("GetVersion() should succeed without SKAPPVER: %v", err)
+	}
+	if version.App != "" {
+		t.Errorf("App version should be empty: %q", version.App)
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	for _, dualStack := range []bool{false, true} {
+		m := sktest.NewModule()
+		m.DualStack = dualStack
+		m.Meter = sktest.NewMeter()
+		dev := newTestDevice(t, m)
+		if err := dev.Authenticate(); err != nil {
+			t.Fatalf("Authenticate() error: %v", err)
+		}
+
+		info, err := dev.GetInfo()
+		if err != nil {
+			t.Fatalf("GetInfo() error: %v", err)
+		}
+		if info.IPAddr.String() != "fe80::21d:1290:1234:5678" || info.MAC.String() != "00:1d:12:90:12:34:56:78" {
+			t.Errorf("Unexpected address: %s", info)
+		}
+		if info.Channel != 0x33 || info.PANID != 0x8888 || info.Addr16 != 0xFFFE || info.DualStack != dualStack {
+			t.Errorf("Unexpected module info: %+v", info)
+		}
+		m.Close()
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, dualStack := range []bool{false, true} {
+		m := sktest.NewModule()
+		m.DualStack = dualStack
+		m.Meter = sktest.NewMeter()
+		dev := newTestDevice(t, m)
+
+		if err := dev.Authenticate(); err != nil {
+			t.Fatalf("Authenticate() error (dualStack=%v): %v", dualStack, err)
+		}
+		if dev.Channel != "33" {
+			t.Errorf("Channel differ: %q != %q", dev.Channel, "33")
+		}
+		if dev.IPAddr != m.Meter.IPAddr() {
+			t.Errorf("IPAddr differ: %q != %q", dev.IPAddr, m.Meter.IPAddr())
+		}
+		if v := m.Register("S03"); v != "8888" {
+			t.Errorf("PAN ID register differ: %q != %q", v, "8888")
+		}
+		m.Close()
+	}
+}
+
+func TestAuthenticateWrongPassword(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.Password("WRONGPASSWD0"))
+
+	if err := dev.Authenticate(); err == nil {
+		t.Errorf("Authenticate() should fail with wrong password")
+	}
+}
+
+func TestQueryEchonetLite(t *testing.T) {
+	tests := []struct {
+		dualStack bool
+		omitLQI   bool
+		display   smartmeter.DisplayMode
+	}{
+		{false, false, smartmeter.DisplayASCII},
+		{false, false, smartmeter.DisplayBinary},
+		{true, false, smartmeter.DisplayASCII},
+		{true, false, smartmeter.DisplayBinary},
+		// <LQI>を出力しないデュアルスタックモジュール
+		{true, true, smartmeter.DisplayASCII},
+		{true, true, smartmeter.DisplayBinary},
+	}
+	for _, tt := range tests {
+		m := sktest.NewModule()
+		m.DualStack = tt.dualStack
+		m.OmitLQI = tt.omitLQI
+		m.Meter = sktest.NewMeter()
+		dev := newTestDevice(t, m, smartmeter.Display(tt.display))
+		if err := dev.Authenticate(); err != nil {
+			t.Fatalf("Authenticate() error: %v", err)
+		}
+
+		req := newInstantaneousPowerRequest()
+		res, err := dev.QueryEchonetLite(req)
+		if err != nil {
+			t.Fatalf("QueryEchonetLite() error (%+v): %v", tt, err)
+		}
+		if p := res.Packet; p == nil || p.HasLQI != (tt.dualStack && !tt.omitLQI) {
+			t.Errorf("HasLQI differ (%+v): %+v", tt, p)
+		}
+		if !res.CorrespondTo(req) {
+			t.Errorf("Response does not correspond to request: %+v", res)
+		}
+		if got := res.Properties[0].Desc(); got != "Instantaneous Electric Power: 389.000000 [W]\n" {
+			t.Errorf("Unexpected property: %q", got)
+		}
+		m.Close()
+	}
+}
+
+func TestQueryEchonetLiteRetry(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.Inject(sktest.Fault{
+		Command: "SKSENDTO",
+		Lines:   []string{"EVENT 21 " + m.Meter.IPAddr() + " 01", "OK"},
+		Times:   2,
+	})
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest(), smartmeter.Retry(1)); err == nil {
+		t.Errorf("QueryEchonetLite() should fail when retries are exhausted")
+	}
+
+	m.Inject(sktest.Fault{
+		Command: "SKSENDTO",
+		Lines:   []string{"EVENT 21 " + m.Meter.IPAddr() + " 01", "OK"},
+	})
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest(), smartmeter.Retry(1)); err != nil {
+		t.Errorf("QueryEchonetLite() should succeed after retry: %v", err)
+	}
+}
+
+func TestQueryEchonetLiteTimeout(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.Inject(sktest.Fault{Command: "SKSENDTO"})
+	_, err := dev.QueryEchonetLite(newInstantaneousPowerRequest(), smartmeter.Timeout(50*time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("QueryEchonetLite() should time out: %v", err)
+	}
+}
+
+func TestJoinRetry(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if _, err := dev.Scan(); err != nil {
+		t.Fatalf("Scan() error: %v", err)
+	}
+	if err := dev.SetRegisterValue("S02", dev.Channel); err != nil {
+		t.Fatalf("SetRegisterValue() error: %v", err)
+	}
+	if err := dev.SetRegisterValue("S03", "8888"); err != nil {
+		t.Fatalf("SetRegisterValue() error: %v", err)
+	}
+
+	m.Inject(sktest.Fault{
+		Command: "SKJOIN",
+		Lines:   []string{"OK", "EVENT 24 " + m.Meter.IPAddr()},
+	})
+	if err := dev.Join(smartmeter.Retry(1)); err != nil {
+		t.Errorf("Join() should succeed after retry: %v", err)
+	}
+}
+
+func TestQuerySKCommandFail(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	_, err := dev.GetRegisterValue("S99")
+	var skErr *smartmeter.SKError
+	if !errors.As(err, &skErr) {
+		t.Fatalf("GetRegisterValue() should return SKError for unknown register: %v", err)
+	}
+	if skErr.Code != smartmeter.ErrCodeInvalidArg || skErr.Command != "SKSREG" {
+		t.Errorf("Unexpected SKError: %+v", skErr)
+	}
+}
+
+func TestRetryOn(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	m.Inject(sktest.Fault{Command: "SKVER", Lines: []string{sktest.FailLine(10)}})
+	if _, err := dev.GetVersion(smartmeter.Retry(1)); err == nil {
+		t.Errorf("GetVersion() should not retry on ER10 by default")
+	}
+
+	m.Inject(sktest.Fault{Command: "SKVER", Lines: []string{sktest.FailLine(10)}})
+	if _, err := dev.GetVersion(smartmeter.Retry(1), smartmeter.RetryOn(smartmeter.ErrCodeExecFailed)); err != nil {
+		t.Errorf("GetVersion() should succeed after retry on ER10: %v", err)
+	}
+}
+
+func TestGetNeibourIP(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	ipAddr, err := dev.GetNeibourIP()
+	if err != nil {
+		t.Fatalf("GetNeibourIP() error: %v", err)
+	}
+	if ipAddr != m.Meter.IPAddr() {
+		t.Errorf("IPAddr differ: %q != %q", ipAddr, m.Meter.IPAddr())
+	}
+}
+
+func TestScanContextCancel(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	m.Inject(sktest.Fault{Command: "SKSCAN", Lines: []string{"OK"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := dev.ScanContext(ctx, smartmeter.Timeout(10*time.Second))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ScanContext() should be canceled: %v", err)
+	}
+}
+
+func TestQueryEchonetLiteContextDeadlineDuringRetry(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.Inject(sktest.Fault{
+		Command: "SKSENDTO",
+		Lines:   []string{"EVENT 21 " + m.Meter.IPAddr() + " 01", "OK"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := dev.QueryEchonetLiteContext(ctx, newInstantaneousPowerRequest(),
+		smartmeter.Retry(3), smartmeter.RetryInterval(10*time.Second))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("QueryEchonetLiteContext() should exceed deadline: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Retry sleep was not interrupted")
+	}
+}
+
+func TestCloseUnblocksQuery(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	m.Inject(sktest.Fault{Command: "SKSCAN", Lines: []string{"OK"}})
+	time.AfterFunc(50*time.Millisecond, func() { dev.Close() })
+	_, err := dev.Scan(smartmeter.Timeout(10 * time.Second))
+	if !errors.Is(err, smartmeter.ErrClosed) {
+		t.Errorf("Scan() should return ErrClosed: %v", err)
+	}
+	if _, err := dev.GetVersion(); !errors.Is(err, smartmeter.ErrClosed) {
+		t.Errorf("GetVersion() after Close() should return ErrClosed: %v", err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Errorf("Close() should be idempotent: %v", err)
+	}
+}
+
+func TestReadError(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	m.Disconnect()
+	_, err := dev.GetVersion()
+	var readErr *smartmeter.ReadError
+	if !errors.As(err, &readErr) {
+		t.Fatalf("GetVersion() should return ReadError: %v", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("ReadError should wrap io.EOF: %v", err)
+	}
+}
+
+// timeoutPort はReadTimeout()を指定したシリアルポートのように、データを返す前に毎回(0, io.EOF)を返す
+type timeoutPort struct {
+	*sktest.Module
+	idle bool
+}
+
+func (p *timeoutPort) Read(b []byte) (int, error) {
+	if p.idle = !p.idle; p.idle {
+		return 0, io.EOF
+	}
+	return p.Module.Read(b)
+}
+
+func TestReadTimeout(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev, err := smartmeter.NewDevice(&timeoutPort{Module: m}, smartmeter.ReadTimeout(100*time.Millisecond), smartmeter.Timeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewDevice() error: %v", err)
+	}
+	defer dev.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := dev.GetVersion(); err != nil {
+			t.Fatalf("GetVersion() should ignore read timeout: %v", err)
+		}
+	}
+}
+
+// blockingPort はブロッキングモードのシリアルポートのように、Close()しても読み込み中のRead()を中断しない
+// 読み込みタイムアウトごとに(0, io.EOF)を返す
+type blockingPort struct {
+	*sktest.Module
+	data  chan []byte
+	reads int32
+}
+
+func newBlockingPort(m *sktest.Module) *blockingPort {
+	p := &blockingPort{Module: m, data: make(chan []byte)}
+	go func() {
+		for {
+			buf := make([]byte, 256)
+			n, err := m.Read(buf)
+			if err != nil {
+				return
+			}
+			p.data <- buf[:n]
+		}
+	}()
+	return p
+}
+
+func (p *blockingPort) Read(b []byte) (int, error) {
+	atomic.AddInt32(&p.reads, 1)
+	select {
+	case buf := <-p.data:
+		return copy(b, buf), nil
+	case <-time.After(10 * time.Millisecond):
+		return 0, io.EOF
+	}
+}
+
+func (p *blockingPort) Close() error {
+	return nil
+}
+
+func TestCloseStopsReaderWithReadTimeout(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	port := newBlockingPort(m)
+	dev, err := smartmeter.NewDevice(port, smartmeter.ReadTimeout(10*time.Millisecond), smartmeter.Timeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewDevice() error: %v", err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	// 読み込みタイムアウトで戻ったところでClose()に気付き、それ以上読まない
+	time.Sleep(50 * time.Millisecond)
+	reads := atomic.LoadInt32(&port.reads)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&port.reads); n != reads {
+		t.Errorf("Reader should stop after Close(): %d != %d", n, reads)
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			req := newInstantaneousPowerRequest()
+			res, err := dev.QueryEchonetLite(req)
+			if err == nil && !res.CorrespondTo(req) {
+				err = errors.New("response does not correspond to request")
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			v, err := dev.GetRegisterValue("S03")
+			if err == nil && v != "8888" {
+				err = errors.New("unexpected register value: " + v)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent query error: %v", err)
+	}
+}
+
+func TestScanMultiplePANs(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	m.Meter.LQI = 0x40
+	other := sktest.NewMeter()
+	other.Channel = 0x21
+	other.PanID = 0x1234
+	other.MACAddr = "001C640003AB0001"
+	other.LQI = 0xF0
+	m.Others = []*sktest.Meter{other}
+	defer m.Close()
+
+	dev := newTestDevice(t, m, smartmeter.SelectPAN(func(pans []smartmeter.PANDescriptor) (smartmeter.PANDescriptor, error) {
+		for _, p := range pans {
+			if p.PanID == 0x8888 {
+				return p, nil
+			}
+		}
+		return smartmeter.PANDescriptor{}, smartmeter.ErrPANNotFound
+	}))
+	pans, err := dev.Scan()
+	if err != nil {
+		t.Fatalf("Scan() error: %v", err)
+	}
+	if len(pans) != 2 {
+		t.Errorf("Number of PANs differ: %d != 2", len(pans))
+	}
+	if dev.Channel != "33" || dev.IPAddr != m.Meter.IPAddr() {
+		t.Errorf("Wrong PAN selected: channel=%s, ipAddr=%s", dev.Channel, dev.IPAddr)
+	}
+	if err := dev.Authenticate(); err != nil {
+		t.Errorf("Authenticate() error: %v", err)
+	}
+}
+
+func TestScanNotFound(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.Channel("21"))
+
+	if _, err := dev.Scan(); !errors.Is(err, smartmeter.ErrPANNotFound) {
+		t.Errorf("Scan() should return ErrPANNotFound: %v", err)
+	}
+}
+
+func TestSendAndReceiveUDP(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	handle, err := dev.OpenUDPHandle(0x1234)
+	if err != nil {
+		t.Fatalf("OpenUDPHandle() error: %v", err)
+	}
+	if handle != 3 {
+		t.Errorf("Handle differ: %d != 3", handle)
+	}
+	if h, err := dev.OpenUDPHandle(0x1234); err != nil || h != handle {
+		t.Errorf("OpenUDPHandle() should reuse the handle: %d, %v", h, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := dev.ReceiveUDP(ctx)
+	dst := net.ParseIP("fe80::21c:6400:30c:12a4")
+	if err := dev.SendUDP(handle, dst, 7, false, 0, []byte("ping")); err != nil {
+		t.Fatalf("SendUDP() error: %v", err)
+	}
+	select {
+	case p := <-ch:
+		if p.SrcPort != 7 || p.DstPort != 0x1234 || p.Secured || string(p.Data) != "ping" {
+			t.Errorf("Unexpected UDP packet: %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("UDP packet was not received")
+	}
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("ReceiveUDP() channel should be closed after cancel")
+	}
+
+	if err := dev.CloseUDPHandle(handle); err != nil {
+		t.Fatalf("CloseUDPHandle() error: %v", err)
+	}
+	var skErr *smartmeter.SKError
+	if err := dev.SendUDP(handle, dst, 7, false, 0, []byte("ping")); !errors.As(err, &skErr) {
+		t.Errorf("SendUDP() from closed handle should fail: %v", err)
+	}
+	if err := dev.SendUDP(9, dst, 7, false, 0, nil); err == nil {
+		t.Errorf("SendUDP() should reject invalid handle")
+	}
+}
+
+func TestSendUDPBackToBack(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	// EVENT 21の後のOKを読み残すと、次のクエリがそのOKで終わってしまう
+	dst := net.ParseIP(m.Meter.IPAddr())
+	for i := 0; i < 20; i++ {
+		if err := dev.SendUDP(1, dst, 0x1234, true, 0, []byte("ping")); err != nil {
+			t.Fatalf("SendUDP() #%d error: %v", i, err)
+		}
+		if err := dev.SendUDP(1, dst, 0x1234, true, 0, []byte("ping")); err != nil {
+			t.Fatalf("SendUDP() #%d error: %v", i, err)
+		}
+		if v, err := dev.GetRegisterValue("S02"); err != nil || v != dev.SessionInfo().Channel {
+			t.Fatalf("GetRegisterValue() after SendUDP() differ: %q, %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package smartmeter
+
+import (
+	"strings"
+	"sync"
+)
+
+// subscriber はOnEvent/OnUDPで登録された購読者
+// 購読者ごとにキューとgoroutineを持つので、遅い購読者がシリアルポートの読み込みを止めることはない
+type subscriber struct {
+	match func(interface{}) bool
+	queue chan interface{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// inbox は実行中のクエリ宛ての行を溜めるキュー
+// クエリのReaderが遅かったりリトライ待ちだったりしても、dispatchを待たせずに全ての行を順に渡す
+type inbox struct {
+	mu    sync.Mutex
+	lines []string
+	wake  chan struct{}
+}
+
+func (in *inbox) push(line string) {
+	in.mu.Lock()
+	in.lines = append(in.lines, line)
+	in.mu.Unlock()
+	select {
+	case in.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (in *inbox) pop() (line string, ok bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.lines) == 0 {
+		return "", false
+	}
+	line = in.lines[0]
+	in.lines = in.lines[1:]
+	return line, true
+}
+
+// forward はキューに溜まった行をクエリが読むたびに1行ずつoutに渡す
+// クエリが終わるかDeviceが閉じられると、残りの行を捨てて終了する
+func (in *inbox) forward(out chan<- string, detached, closed <-chan struct{}) {
+	for {
+		line, ok := in.pop()
+		if !ok {
+			select {
+			case <-in.wake:
+				continue
+			case <-detached:
+				return
+			case <-closed:
+				return
+			}
+		}
+		select {
+		case out <- line:
+		case <-detached:
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// dispatch はモジュールから受信した1行を購読者と実行中のクエリに振り分ける
+// EVENTとERXUDPは実行中のクエリの有無にかかわらず購読者に通知される
+// 実行中のクエリがなければ、その他の行は捨てられる（次のクエリが古い行を読むことはない）
+// 実行中のクエリ宛ての行は捨てずにキューに溜めるので、クエリが遅くても購読者への通知は止まらない
+func (d *Device) dispatch(line string) {
+	// ModuleProfileの判別前（Open()の途中）は書式が分からないので、購読者には通知しない
+	if profile := d.Profile(); profile != nil {
+		d.notifyLine(profile, line)
+	}
+
+	d.mu.Lock()
+	active := d.active
+	d.mu.Unlock()
+	if active == nil {
+		d.debugf("<< %q (unsolicited)\n", line)
+		return
+	}
+	active.push(line)
+}
+
+// notifyLine はEVENT, ERXUDP, ETCP, ERXTCPの行を解釈して状態を更新し、購読者に通知する
+func (d *Device) notifyLine(profile ModuleProfile, line string) {
+	if strings.HasPrefix(line, "EVENT ") {
+		if ev, err := profile.ParseEvent(line); err == nil {
+			d.updateSession(ev)
+			d.updateTransmitLimit(ev)
+			d.notify(ev)
+		} else {
+			d.warnf("EVENT parse error: %+v", err)
+		}
+	} else if strings.HasPrefix(line, "ERXUDP ") {
+		if p, err := profile.ParseUDP(line, d.DisplayMode()); err == nil {
+			if p.HasLQI && p.Side == 0 {
+				d.recordLinkQuality(p.LQI, p.Time)
+			}
+			d.notify(*p)
+		} else {
+			d.warnf("ERXUDP parse error: %+v", err)
+		}
+	} else if strings.HasPrefix(line, "ETCP ") {
+		if ev, err := parseTCPEvent(line); err == nil {
+			d.notify(*ev)
+		} else {
+			d.warnf("ETCP parse error: %+v", err)
+		}
+	} else if strings.HasPrefix(line, "ERXTCP ") {
+		if s, err := parseTCPSegment(line, d.DisplayMode()); err == nil {
+			d.notify(*s)
+		} else {
+			d.warnf("ERXTCP parse error: %+v", err)
+		}
+	}
+}
+
+// attach は実行中のクエリとしてレスポンスの受け取り口を登録する
+func (d *Device) attach() chan string {
+	ch := make(chan string)
+	in := &inbox{wake: make(chan struct{}, 1)}
+	detached := make(chan struct{})
+	d.mu.Lock()
+	d.active = in
+	d.detached = detached
+	d.mu.Unlock()
+	go in.forward(ch, detached, d.closed)
+	return ch
+}
+
+func (d *Device) detach() {
+	d.mu.Lock()
+	d.active = nil
+	close(d.detached)
+	d.detached = nil
+	d.mu.Unlock()
+}
+
+// OnEvent は指定したEVENT番号のイベントを受け取るコールバックを登録する
+// 戻り値の関数を呼ぶと登録を解除する
+func (d *Device) OnEvent(code EventCode, fn func(Event)) (cancel func()) {
+	return d.subscribe(func(v interface{}) bool {
+		ev, ok := v.(Event)
+		return ok && ev.Code == code
+	}, func(v interface{}) {
+		fn(v.(Event))
+	})
+}
+
+// OnUDP はERXUDPで受信した全てのUDPパケットを受け取るコールバックを登録する
+// 戻り値の関数を呼ぶと登録を解除する
+func (d *Device) OnUDP(fn func(UDPPacket)) (cancel func()) {
+	return d.subscribe(func(v interface{}) bool {
+		_, ok := v.(UDPPacket)
+		return ok
+	}, func(v interface{}) {
+		fn(v.(UDPPacket))
+	})
+}
+
+func (d *Device) subscribe(match func(interface{}) bool, fn func(interface{})) (cancel func()) {
+	s := &subscriber{
+		match: match,
+		queue: make(chan interface{}, 16),
+		done:  make(chan struct{}),
+	}
+	d.mu.Lock()
+	d.subscribers = append(d.subscribers, s)
+	d.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case v := <-s.queue:
+				fn(v)
+			case <-s.done:
+				return
+			case <-d.closed:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		s.once.Do(func() {
+			close(s.done)
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			for i, t := range d.subscribers {
+				if t == s {
+					d.subscribers = append(d.subscribers[:i], d.subscribers[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+func (d *Device) notify(v interface{}) {
+	d.mu.Lock()
+	subscribers := append([]*subscriber(nil), d.subscribers...)
+	d.mu.Unlock()
+	for _, s := range subscribers {
+		if !s.match(v) {
+			continue
+		}
+		select {
+		case s.queue <- v:
+		default:
+			d.warnf("Subscriber is too slow. Dropped: %+v", v)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package smartmeter_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestOnEvent(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	events := make(chan smartmeter.Event, 1)
+	cancel := dev.OnEvent(0x29, func(ev smartmeter.Event) {
+		events <- ev
+	})
+	defer cancel()
+
+	m.Emit("EVENT 29 " + m.Meter.IPAddr())
+	select {
+	case ev := <-events:
+		if ev.Code != 0x29 || ev.Sender.String() != "fe80::21c:6400:30c:12a4" {
+			t.Errorf("Unexpected event: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("EVENT 29 was not delivered")
+	}
+}
+
+func TestOnUDP(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	packets := make(chan smartmeter.UDPPacket, 1)
+	cancel := dev.OnUDP(func(p smartmeter.UDPPacket) {
+		packets <- p
+	})
+	defer cancel()
+
+	// スマートメーターからのINF（0x73）
+	m.Emit(fmt.Sprintf("ERXUDP %s %s 0E1A 0E1A %s 1 0019 108100000288010EF0017301EA0B07E4010100000000000064",
+		m.Meter.IPAddr(), m.IPAddr(), m.Meter.MACAddr))
+	select {
+	case p := <-packets:
+		if p.SrcPort != 3610 || !p.Secured || len(p.Data) != 0x19 {
+			t.Errorf("Unexpected packet: %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ERXUDP was not delivered")
+	}
+}
+
+func TestUnsolicitedLinesAreNotDeliveredToNextQuery(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	m.Emit("EVER 9.9.9", "OK")
+	time.Sleep(50 * time.Millisecond)
+	version, err := dev.GetVersion()
+	if err != nil {
+		t.Fatalf("GetVersion() error: %v", err)
+	}
+	if version.String() != "1.2.10 (rev26e)" {
+		t.Errorf("GetVersion() read a stale line: %s", version)
+	}
+}
+
+func TestSlowSubscriberDoesNotStallReader(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	block := make(chan struct{})
+	defer close(block)
+	cancel := dev.OnEvent(0x29, func(ev smartmeter.Event) {
+		<-block
+	})
+	defer cancel()
+
+	for i := 0; i < 200; i++ {
+		m.Emit("EVENT 29 " + m.Meter.IPAddr())
+	}
+	if _, err := dev.GetVersion(); err != nil {
+		t.Errorf("GetVersion() error: %v", err)
+	}
+}
+
+func TestSlowReaderDoesNotLoseLines(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("ELINE %d", i)
+	}
+	m.Inject(sktest.Fault{Command: "SKVER", Lines: append(lines, "OK")})
+
+	n := 0
+	callback := func(line string) (bool, error) {
+		time.Sleep(time.Millisecond)
+		if strings.HasPrefix(line, "ELINE ") {
+			n++
+		}
+		return line == "OK", nil
+	}
+	if _, err := dev.QuerySKCommand("SKVER", smartmeter.Reader(callback)); err != nil {
+		t.Fatalf("QuerySKCommand() error: %v", err)
+	}
+	if n != len(lines) {
+		t.Errorf("Number of lines differ: %d != %d", n, len(lines))
+	}
+}
+
+func TestSlowReaderDoesNotStallSubscribers(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	events := make(chan smartmeter.Event, 1)
+	cancel := dev.OnEvent(0x29, func(ev smartmeter.Event) {
+		events <- ev
+	})
+	defer cancel()
+
+	// クエリのReaderが止まっている間に多数の行の後に届いたEVENTも購読者に通知される
+	lines := []string{"EVER 1.2.10"}
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("ELINE %d", i))
+	}
+	lines = append(lines, "EVENT 29 "+m.Meter.IPAddr(), "OK")
+	m.Inject(sktest.Fault{Command: "SKVER", Lines: lines})
+	block := make(chan struct{})
+	callback := func(line string) (bool, error) {
+		if strings.HasPrefix(line, "EVER ") {
+			<-block
+		}
+		return line == "OK", nil
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := dev.QuerySKCommand("SKVER", smartmeter.Reader(callback))
+		errCh <- err
+	}()
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Errorf("EVENT 29 was not delivered while the query was blocked")
+	}
+	close(block)
+	if err := <-errCh; err != nil {
+		t.Errorf("QuerySKCommand() error: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package smartmeter
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DisplayMode はERXUDPやERXTCPのデータ部の表示形式
+type DisplayMode int
+
+const (
+	DisplayASCII  DisplayMode = iota // 16進ASCII表示（WOPT 01）。行単位で扱えるのでデフォルト
+	DisplayBinary                    // バイナリ表示（WOPT 00）
+)
+
+func (m DisplayMode) String() string {
+	if m == DisplayBinary {
+		return "binary"
+	}
+	return "ASCII"
+}
+
+// DisplayMode はモジュールの実際の表示形式を返す
+func (d *Device) DisplayMode() DisplayMode {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.display
+}
+
+func (d *Device) setDisplayMode(mode DisplayMode) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.display = mode
+}
+
+// negotiateDisplayMode はROPTで現在の表示形式を調べ、Display()で指定した形式と異なればWOPTで書き換える
+// WOPTはフラッシュに書き込まれるので、Display()を指定していないか同じ形式なら何もしない
+func (d *Device) negotiateDisplayMode(ctx context.Context, opts ...Option) (err error) {
+	if !d.Profile().Supports(FeatureDisplayOption) {
+		return d.assumeDisplayMode()
+	}
+	current, err := d.GetDisplayOptionContext(ctx, opts...)
+	var skErr *SKError
+	if errors.As(err, &skErr) && skErr.Code == ErrCodeUnsupportedCommand {
+		return d.assumeDisplayMode()
+	} else if err != nil {
+		return
+	}
+	if d.wantDisplay == nil || current == *d.wantDisplay {
+		return
+	}
+	if err = d.SetDisplayOptionContext(ctx, *d.wantDisplay, opts...); err != nil {
+		return
+	}
+	d.infof("Display mode changed: %s -> %s", current, *d.wantDisplay)
+	return
+}
+
+// assumeDisplayMode はWOPT/ROPTに対応していないモジュールの表示形式をModuleProfileのデフォルトとみなす
+// Display()でそれ以外の形式を指定されていたら、切り替える手段がないのでエラーを返す
+func (d *Device) assumeDisplayMode() error {
+	mode := d.Profile().DefaultDisplayMode()
+	if d.wantDisplay != nil && *d.wantDisplay != mode {
+		return fmt.Errorf("%s cannot change display mode to %s", d.Profile().Name(), *d.wantDisplay)
+	}
+	d.setDisplayMode(mode)
+	return nil
+}
+
+func (d *Device) GetDisplayOption(opts ...Option) (mode DisplayMode, err error) {
+	return d.GetDisplayOptionContext(context.Background(), opts...)
+}
+
+// GetDisplayOptionContext はモジュールに設定されている表示形式（ROPT）を取得する
+// 表示形式は仮想レジスタではないので、DumpRegisters()には含まれない
+func (d *Device) GetDisplayOptionContext(ctx context.Context, opts ...Option) (mode DisplayMode, err error) {
+	callback := func(line string) (bool, error) {
+		// ROPTは「OK <MODE>」を返す
+		return strings.HasPrefix(line, "OK"), nil
+	}
+	roptOpts := append([]Option{Reader(callback)}, opts...)
+	res, err := d.QuerySKCommandContext(ctx, "ROPT", roptOpts...)
+	if err != nil {
+		return
+	}
+	i := strings.LastIndex(res, "OK ")
+	if i < 0 {
+		return mode, fmt.Errorf("Unexpected response for ROPT: %s", res)
+	}
+	switch strings.TrimSpace(res[i+3:]) {
+	case "00":
+		mode = DisplayBinary
+	case "01":
+		mode = DisplayASCII
+	default:
+		return mode, fmt.Errorf("Unexpected response for ROPT: %s", res)
+	}
+	d.setDisplayMode(mode)
+	return
+}
+
+func (d *Device) SetDisplayOption(mode DisplayMode, opts ...Option) error {
+	return d.SetDisplayOptionContext(context.Background(), mode, opts...)
+}
+
+// SetDisplayOptionContext はモジュールの表示形式を設定する（WOPT）
+// WOPTの設定はフラッシュに書き込まれるので、頻繁に呼ばないこと
+func (d *Device) SetDisplayOptionContext(ctx context.Context, mode DisplayMode, opts ...Option) (err error) {
+	cmd := "WOPT 01"
+	if mode == DisplayBinary {
+		cmd = "WOPT 00"
+	}
+	if _, err = d.QuerySKCommandContext(ctx, cmd, opts...); err != nil {
+		return
+	}
+	d.setDisplayMode(mode)
+	return
+}
+
+// readLine はモジュールから1行読む
+// バイナリ表示のERXUDPとERXTCPはデータに改行が含まれうるので、<DATALEN>を見てデータ部を読む
+func (d *Device) readLine(r *bufio.Reader) (line string, err error) {
+	var buf []byte
+	for {
+		var c byte
+		if c, err = r.ReadByte(); err != nil {
+			return
+		}
+		if c == '\n' {
+			return strings.TrimRight(string(buf), "\r"), nil
+		}
+		buf = append(buf, c)
+		if c != ' ' || d.DisplayMode() != DisplayBinary {
+			continue
+		}
+		n, ok := binaryDataLen(string(buf), d.Profile().DualStack())
+		if !ok {
+			continue
+		}
+		data := make([]byte, n)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return
+		}
+		// データの後ろの改行まで読み捨てる
+		if _, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		return string(append(buf, data...)), nil
+	}
+}
+
+// binaryDataLen は読み込み途中の行がERXUDPかERXTCPの<DATALEN>まで読んだところなら、そのデータ長を返す
+// dualがtrueならERXUDPをデュアルスタックモジュールの書式（<SIDE>と省略可能な<LQI>付き）として数える
+func binaryDataLen(header string, dual bool) (n int, ok bool) {
+	fields := strings.Fields(header)
+	switch {
+	case len(fields) > 6 && fields[0] == "ERXUDP":
+		if udpFields, _ := udpHeaderFields(fields[6], dual); len(fields) != udpFields {
+			return 0, false
+		}
+	case len(fields) == 5 && fields[0] == "ERXTCP":
+	default:
+		return 0, false
+	}
+	last := fields[len(fields)-1]
+	if len(last) != 4 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(last, 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return int(v), true
+}
+
+// decodeData は表示形式に従ってERXUDPとERXTCPのデータ部を復元する
+func decodeData(s string, dataLen int, mode DisplayMode) (data []byte, err error) {
+	if mode == DisplayBinary {
+		if len(s) != dataLen {
+			return nil, fmt.Errorf("Data length mismatch: %d != %d", len(s), dataLen)
+		}
+		return []byte(s), nil
+	}
+	if len(s) != 2*dataLen {
+		return nil, fmt.Errorf("Data length mismatch: %d != %d", len(s), 2*dataLen)
+	}
+	if data, err = hex.DecodeString(s); err != nil {
+		return nil, fmt.Errorf("Data is not a hexadecimal: %s", s)
+	}
+	return
+}
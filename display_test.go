@@ -0,0 +1,117 @@
+package smartmeter_test
+
+import (
+	"bytes"
+	"testing"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestDisplayModeNegotiation(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+
+	// Display()を指定しなければモジュールの設定（シミュレータはバイナリ表示）に従い、フラッシュに書き込まない
+	dev := newTestDevice(t, m)
+	if mode := dev.DisplayMode(); mode != smartmeter.DisplayBinary {
+		t.Errorf("DisplayMode() differ: %s != %s", mode, smartmeter.DisplayBinary)
+	}
+	if n := countCommand(m, "WOPT"); n != 0 {
+		t.Errorf("WOPT count differ: %d != 0", n)
+	}
+	dev.Close()
+
+	// 指定した場合だけWOPTで16進ASCII表示に切り替える
+	m = sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev = newTestDevice(t, m, smartmeter.Display(smartmeter.DisplayASCII))
+	defer dev.Close()
+	if mode := dev.DisplayMode(); mode != smartmeter.DisplayASCII {
+		t.Errorf("DisplayMode() differ: %s != %s", mode, smartmeter.DisplayASCII)
+	}
+	if n := countCommand(m, "WOPT"); n != 1 {
+		t.Errorf("WOPT count differ: %d != 1", n)
+	}
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Errorf("QueryEchonetLite() error: %v", err)
+	}
+}
+
+func TestDisplayModeBinary(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	// データ部に改行が含まれていても、データ長を見て読み込む
+	edt := []byte{0x00, 0x00, 0x0D, 0x0A}
+	m.Meter.Properties[smartmeter.LvSmartElectricEnergyMeter_InstantaneousElectricPower] = edt
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.Display(smartmeter.DisplayBinary))
+
+	if mode := dev.DisplayMode(); mode != smartmeter.DisplayBinary {
+		t.Errorf("DisplayMode() differ: %s != %s", mode, smartmeter.DisplayBinary)
+	}
+	if n := countCommand(m, "WOPT"); n != 0 {
+		t.Errorf("WOPT should not be sent when the mode already matches: %d", n)
+	}
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	res, err := dev.QueryEchonetLite(newInstantaneousPowerRequest())
+	if err != nil {
+		t.Fatalf("QueryEchonetLite() error: %v", err)
+	}
+	if len(res.Properties) != 1 || !bytes.Equal(res.Properties[0].EDT, edt) {
+		t.Errorf("Property differ: %+v", res.Properties)
+	}
+}
+
+func TestDisplayOption(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	if err := dev.SetDisplayOption(smartmeter.DisplayBinary); err != nil {
+		t.Fatalf("SetDisplayOption() error: %v", err)
+	}
+	mode, err := dev.GetDisplayOption()
+	if err != nil {
+		t.Fatalf("GetDisplayOption() error: %v", err)
+	}
+	if mode != smartmeter.DisplayBinary || dev.DisplayMode() != smartmeter.DisplayBinary {
+		t.Errorf("Display mode differ: %s, %s != %s", mode, dev.DisplayMode(), smartmeter.DisplayBinary)
+	}
+}
+
+func TestDisplayModeUnsupported(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	m.Inject(sktest.Fault{Command: "ROPT", Lines: []string{sktest.FailLine(4)}})
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	if mode := dev.DisplayMode(); mode != smartmeter.DisplayASCII {
+		t.Errorf("DisplayMode() differ: %s != %s", mode, smartmeter.DisplayASCII)
+	}
+	if n := countCommand(m, "WOPT"); n != 0 {
+		t.Errorf("WOPT should not be sent to modules without ROPT: %d", n)
+	}
+}
+
+func TestDisplayModeUnsupportedWithExplicitMode(t *testing.T) {
+	m := sktest.NewModule()
+	defer m.Close()
+	asciiOnly := &smartmeter.SKStackProfile{Model: "ASCIIOnly"}
+	_, err := smartmeter.NewDevice(m, smartmeter.Profile(asciiOnly), smartmeter.Display(smartmeter.DisplayBinary))
+	if err == nil {
+		t.Errorf("NewDevice() should fail when the display mode cannot be changed")
+	}
+	if n := countCommand(m, "ROPT") + countCommand(m, "WOPT"); n != 0 {
+		t.Errorf("ROPT/WOPT should not be sent: %d", n)
+	}
+}
@@ -0,0 +1,87 @@
+package smartmeter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrClosed はClose()済みのDeviceを操作したときに返る
+var ErrClosed = errors.New("Device is closed")
+
+// ErrTimeout はSKコマンドのレスポンスがタイムアウトしたときに返る
+var ErrTimeout = errors.New("SK command timeout")
+
+// ReadError はWi-SUNモジュールからの読み込みに失敗したときに返る
+// デバイスの抜去やEOFの場合は、以降の全てのコマンドがこのエラーを返す
+type ReadError struct {
+	Err error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("SK command read error: %v", e.Err)
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// SKErrorCode はSKSTACK-IPのエラーコード（FAIL ERxxのxx）
+type SKErrorCode int
+
+const (
+	ErrCodeUnsupportedCommand SKErrorCode = 4  // ER04: 指定されたコマンドがサポートされていない
+	ErrCodeInvalidArgCount    SKErrorCode = 5  // ER05: 指定されたコマンドの引数の数が正しくない
+	ErrCodeInvalidArg         SKErrorCode = 6  // ER06: 指定されたコマンドの引数形式や値域が正しくない
+	ErrCodeUARTInput          SKErrorCode = 9  // ER09: UART入力エラーが発生した
+	ErrCodeExecFailed         SKErrorCode = 10 // ER10: 指定されたコマンドは受付けたが、実行結果が失敗した
+)
+
+var skErrorDescs = map[SKErrorCode]string{
+	ErrCodeUnsupportedCommand: "unsupported command",
+	ErrCodeInvalidArgCount:    "invalid number of arguments",
+	ErrCodeInvalidArg:         "invalid argument format or range",
+	ErrCodeUARTInput:          "UART input error",
+	ErrCodeExecFailed:         "command accepted but execution failed",
+}
+
+// Desc はエラーコードの説明を返す
+func (c SKErrorCode) Desc() string {
+	if desc, ok := skErrorDescs[c]; ok {
+		return desc
+	}
+	return "reserved error"
+}
+
+func (c SKErrorCode) String() string {
+	return fmt.Sprintf("ER%02d", int(c))
+}
+
+// SKError はSKコマンドに対してモジュールが「FAIL ERxx」を返したときのエラー
+// errors.As()で取り出してエラーコードを確認できる
+type SKError struct {
+	Code    SKErrorCode // エラーコード
+	Command string      // エラーになったコマンド名（"SKSENDTO"など）
+	Desc    string      // エラーコードの説明
+}
+
+func (e *SKError) Error() string {
+	return fmt.Sprintf("SK command response error: %s FAIL %s (%s)", e.Command, e.Code, e.Desc)
+}
+
+// parseSKError は「FAIL ERxx」行からSKErrorを作る
+// パスワードなどを含めないよう、コマンドは名前だけを保持する
+func parseSKError(cmd string, line string) *SKError {
+	name := cmd
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		name = cmd[:i]
+	}
+	var code SKErrorCode
+	if s := strings.TrimPrefix(line, "FAIL ER"); s != line {
+		if n, err := strconv.Atoi(s); err == nil {
+			code = SKErrorCode(n)
+		}
+	}
+	return &SKError{Code: code, Command: name, Desc: code.Desc()}
+}
@@ -0,0 +1,138 @@
+package smartmeter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EventCode はSKSTACK-IPのEVENT番号
+type EventCode uint8
+
+/*
+ * 参考資料
+ *   SKSTACK IP コマンドリファレンスマニュアル「イベント」
+ */
+
+const (
+	EventNSReceived                  EventCode = 0x01 // NSを受信した
+	EventNAReceived                  EventCode = 0x02 // NAを受信した
+	EventEchoRequestReceived         EventCode = 0x05 // Echo Requestを受信した
+	EventEDScanDone                  EventCode = 0x1F // EDスキャンが完了した
+	EventBeaconReceived              EventCode = 0x20 // Beaconを受信した
+	EventUDPSent                     EventCode = 0x21 // UDP送信処理が完了した（PARAM 00: 成功, 01: 失敗, 02: アドレス要請）
+	EventActiveScanDone              EventCode = 0x22 // アクティブスキャンが完了した
+	EventPANAFailed                  EventCode = 0x24 // PANAによる接続過程でエラーが発生した
+	EventPANAConnected               EventCode = 0x25 // PANAによる接続が完了した
+	EventSessionTerminationRequested EventCode = 0x26 // 接続相手からセッション終了要求を受信した
+	EventSessionTerminated           EventCode = 0x27 // PANAセッションの終了に成功した
+	EventSessionTerminationTimeout   EventCode = 0x28 // PANAセッションの終了要求に対する応答がなくタイムアウトした
+	EventSessionExpired              EventCode = 0x29 // セッションのライフタイムが経過して期限切れになった
+	EventTransmitLimitActivated      EventCode = 0x32 // ARIB108の送信総和時間の制限が発動した
+	EventTransmitLimitReleased       EventCode = 0x33 // ARIB108の送信総和時間の制限が解除された
+	EventHANPANAConnected            EventCode = 0x45 // HAN側でPANAによる接続が完了した（デュアルスタックモジュール）
+)
+
+var eventDescs = map[EventCode]string{
+	EventNSReceived:                  "NS received",
+	EventNAReceived:                  "NA received",
+	EventEchoRequestReceived:         "Echo Request received",
+	EventEDScanDone:                  "ED scan completed",
+	EventBeaconReceived:              "Beacon received",
+	EventUDPSent:                     "UDP transmission completed",
+	EventActiveScanDone:              "Active scan completed",
+	EventPANAFailed:                  "PANA connection failed",
+	EventPANAConnected:               "PANA connection established",
+	EventSessionTerminationRequested: "Session termination requested by peer",
+	EventSessionTerminated:           "PANA session terminated",
+	EventSessionTerminationTimeout:   "PANA session termination timed out",
+	EventSessionExpired:              "PANA session expired",
+	EventTransmitLimitActivated:      "Transmission time limit activated",
+	EventTransmitLimitReleased:       "Transmission time limit released",
+	EventHANPANAConnected:            "PANA connection established on HAN",
+}
+
+// Desc はイベントの説明を返す
+func (c EventCode) Desc() string {
+	if desc, ok := eventDescs[c]; ok {
+		return desc
+	}
+	return "Unknown event"
+}
+
+func (c EventCode) String() string {
+	return fmt.Sprintf("EVENT %02X", uint8(c))
+}
+
+// Event はWi-SUNモジュールが出力するEVENT行に対応する構造体
+// 書式: EVENT <NUM> <SENDER> [<SIDE>] [<PARAM>]
+type Event struct {
+	Code     EventCode // イベント番号
+	Sender   net.IP    // イベントの発生元アドレス
+	Side     int       // イベントが発生したインターフェース（0: Bルート, 1: HAN）。デュアルスタックモジュールのみ
+	Param    uint8     // イベント固有のパラメータ
+	HasParam bool      // Paramが存在するか
+}
+
+func (ev Event) String() string {
+	s := fmt.Sprintf("%s (%s) from %s", ev.Code, ev.Code.Desc(), ev.Sender)
+	if ev.HasParam {
+		s += fmt.Sprintf(" param=%02X", ev.Param)
+	}
+	return s
+}
+
+// parseEvent はEVENT行を受け取ってEventを返す
+// sideがtrueならデュアルスタックモジュールの書式（<SENDER>の後に<SIDE>が付く）として解釈する
+func parseEvent(line string, side bool) (ev Event, err error) {
+	fields := strings.Fields(line)
+	n := 3
+	if side {
+		n = 4
+	}
+	if len(fields) < n || len(fields) > n+1 || fields[0] != "EVENT" {
+		err = fmt.Errorf("Unknown EVENT format: %s", line)
+		return
+	}
+	code, err := strconv.ParseUint(fields[1], 16, 8)
+	if err != nil {
+		err = fmt.Errorf("EVENT parse error (not a number): %s", line)
+		return
+	}
+	ev.Code = EventCode(code)
+	ev.Sender = net.ParseIP(fields[2])
+	if ev.Sender == nil {
+		err = fmt.Errorf("EVENT parse error (invalid address): %s", line)
+		return
+	}
+	if side {
+		if ev.Side, err = strconv.Atoi(fields[3]); err != nil {
+			err = fmt.Errorf("EVENT parse error (not a number): %s", line)
+			return
+		}
+	}
+	if len(fields) == n+1 {
+		var v uint64
+		if v, err = strconv.ParseUint(fields[n], 16, 8); err != nil {
+			err = fmt.Errorf("EVENT parse error (not a hexadecimal): %s", line)
+			return
+		}
+		ev.Param = uint8(v)
+		ev.HasParam = true
+	}
+	return
+}
+
+// lineEvent はEVENT行ならModuleProfileの書式で解釈したEventを返す
+func (d *Device) lineEvent(line string) (ev Event, ok bool) {
+	if !strings.HasPrefix(line, "EVENT ") {
+		return
+	}
+	profile := d.Profile()
+	if profile == nil {
+		return
+	}
+	ev, err := profile.ParseEvent(line)
+	return ev, err == nil
+}
@@ -0,0 +1,47 @@
+package smartmeter
+
+import (
+	"testing"
+)
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		line     string
+		side     bool
+		code     EventCode
+		wantSide int
+		param    uint8
+		hasParam bool
+	}{
+		{"EVENT 21 FE80:0000:0000:0000:021C:6400:030C:12A4 02", false, EventUDPSent, 0, 0x02, true},
+		{"EVENT 21 FE80:0000:0000:0000:021C:6400:030C:12A4 0 01", true, EventUDPSent, 0, 0x01, true},
+		{"EVENT 25 FE80:0000:0000:0000:021C:6400:030C:12A4 1", true, EventPANAConnected, 1, 0, false},
+		{"EVENT 22 FE80:0000:0000:0000:021D:1290:1234:5678", false, EventActiveScanDone, 0, 0, false},
+	}
+	for _, tt := range tests {
+		ev, err := parseEvent(tt.line, tt.side)
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+		if ev.Code != tt.code || ev.Side != tt.wantSide || ev.Param != tt.param || ev.HasParam != tt.hasParam {
+			t.Errorf("Unexpected event for %q: %+v", tt.line, ev)
+		}
+		if ev.Sender == nil {
+			t.Errorf("Sender is nil for %q", tt.line)
+		}
+	}
+
+	if _, err := parseEvent("EVENT ZZ FE80:0000:0000:0000:021C:6400:030C:12A4", false); err == nil {
+		t.Errorf("parseEvent() should fail for invalid code")
+	}
+	// 書式はModuleProfileで決まるので、桁数から推測しない
+	if _, err := parseEvent("EVENT 21 FE80:0000:0000:0000:021C:6400:030C:12A4 0 01", false); err == nil {
+		t.Errorf("parseEvent() should fail for dual stack line with single stack layout")
+	}
+	if _, err := parseEvent("EVENT 22 FE80:0000:0000:0000:021D:1290:1234:5678", true); err == nil {
+		t.Errorf("parseEvent() should fail for single stack line with dual stack layout")
+	}
+	if desc := EventSessionExpired.Desc(); desc != "PANA session expired" {
+		t.Errorf("Desc() differ: %q", desc)
+	}
+}
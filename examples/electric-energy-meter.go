@@ -16,10 +16,11 @@ import (
 func main() {
 	dev, err := smartmeter.Open("/dev/ttyACM0",
 		//smartmeter.Verbosity(3),                           // コマンドとレスポンスを全部確認したいときにアンコメントする
-		smartmeter.DualStackSK(true),                      // Bルート専用モジュールを使う場合はコメントアウト
-		smartmeter.ID("00000000000000000000000000000000"), // Bルート認証ID
-		smartmeter.Password("AB0123456789"),               // パスワード
-		smartmeter.Channel("33"))                          // チャンネル。各環境でScan()で取得した値に書き換える。
+		smartmeter.DualStackSK(true),                         // Bルート専用モジュールを使う場合はコメントアウト
+		smartmeter.ID("00000000000000000000000000000000"),    // Bルート認証ID
+		smartmeter.Password("AB0123456789"),                  // パスワード
+		smartmeter.Channel("33"),                             // チャンネル。各環境でScan()で取得した値に書き換える。
+		smartmeter.AutoReauth(smartmeter.ReauthAuthenticate)) // セッションが切れていたら自動で認証し直す
 
 	if err != nil {
 		fmt.Printf("%+v", err)
@@ -42,14 +43,8 @@ func main() {
 		response, err := dev.QueryEchonetLite(request, smartmeter.Retry(3))
 		if err != nil {
 			fmt.Printf("Error: %+v\n", err)
-
-			// 値が取得できなかったので、認証してから再度値を取る
-			err = dev.Authenticate()
-			if err != nil {
-				fmt.Printf("%+v\n", err)
-				return
-			}
-			response, err = dev.QueryEchonetLite(request, smartmeter.Retry(3))
+			time.Sleep(1 * time.Second)
+			continue
 		}
 
 		for _, p := range response.Properties {
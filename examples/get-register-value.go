@@ -35,13 +35,19 @@ func main() {
 		fmt.Printf("Info: %v\n", info)
 	}
 
-	regNames := []string{"S02", "S03", "S07", "S0A", "S15", "S16", "S17", "SA0", "SA1", "SFB", "SFD", "SFE", "SFF"}
-	for _, regName := range regNames {
-		regValue, err := dev.GetRegisterValue(regName)
+	for _, reg := range smartmeter.KnownRegisters {
+		regValue, err := dev.GetRegisterValue(string(reg))
 		if err != nil {
 			fmt.Printf("%+v\n", err)
 		} else {
-			fmt.Printf("%s: %v\n", regName, regValue)
+			fmt.Printf("%s (%s): %v\n", reg, reg.Desc(), regValue)
 		}
 	}
+
+	regs, err := dev.DumpRegisters()
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	} else {
+		fmt.Printf("Registers: %+v\n", *regs)
+	}
 }
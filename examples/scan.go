@@ -3,7 +3,7 @@
 // Do not build by default.
 
 // スキャンのデモ。
-// 環境によっては50%くらいの確率で失敗するので、時間をおいて数回試してください。
+// 環境によっては1回のスキャンでは見つからないことがあるので、スキャン時間を延ばしながら繰り返す。
 
 package main
 
@@ -18,12 +18,25 @@ func main() {
 	dev, err := smartmeter.Open("/dev/ttyACM0",
 		smartmeter.DualStackSK(true),                      // Bルート専用モジュールを使う場合はコメントアウト
 		smartmeter.ID("00000000000000000000000000000000"), // ルートB認証ID
-		smartmeter.Password("AB0123456789"))               // パスワード
+		smartmeter.Password("AB0123456789"),               // パスワード
+		smartmeter.ScanDurations(4, 6, 8),                 // 短いスキャン時間から順に試す
+		smartmeter.ScanBudget(100*time.Second),            // スキャンにかける時間の上限
+		smartmeter.ScanProgressFunc(func(p smartmeter.ScanProgress) {
+			fmt.Printf("Pass %d (duration %d): %s\n", p.Pass, p.Duration, p.Event)
+		}))
 
 	if err != nil {
 		fmt.Printf("%+v", err)
 		return
 	}
 
-	dev.Scan(smartmeter.Timeout(100*time.Second), smartmeter.Verbosity(3))
+	pans, err := dev.Scan()
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return
+	}
+	for _, pan := range pans {
+		fmt.Println(pan)
+	}
+	fmt.Printf("Selected: Channel=%s, IPAddr=%s\n", dev.Channel, dev.IPAddr)
 }
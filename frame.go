@@ -38,6 +38,7 @@ type Frame struct {
 	DEOJ       ClassCode   // 相手先ECHONET Liteオブジェクト
 	ESV        ServiceCode // ECHONET Liteサービス
 	Properties []*Property // ECHONETプロパティ
+	Packet     *UDPPacket  // 受信したUDPパケットの情報（送信元アドレス、LQIなど）。受信したFrame以外ではnil
 }
 
 // NewFrame は Frame構造体のコンストラクタ関数
@@ -0,0 +1,91 @@
+package smartmeter
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+ * 920MHz帯の無線局はARIB STD-T108により送信時間の総和が制限されている
+ * 制限が発動するとモジュールはEVENT 32を出力して送信を拒否し、解除されるとEVENT 33を出力する
+ */
+
+// ErrTransmitLimited は送信総和時間の制限中（EVENT 32からEVENT 33まで）のため送信できないときに返る
+var ErrTransmitLimited = errors.New("Transmission time limit is active (EVENT 32)")
+
+// TransmitLimited は送信総和時間の制限中か返す
+func (d *Device) TransmitLimited() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.limited
+}
+
+// updateTransmitLimit はEVENT 32/33に応じて送信総和時間の制限状態を更新する
+func (d *Device) updateTransmitLimit(ev Event) {
+	switch ev.Code {
+	case EventTransmitLimitActivated:
+		d.setTransmitLimited(true)
+	case EventTransmitLimitReleased:
+		d.setTransmitLimited(false)
+	}
+}
+
+func (d *Device) setTransmitLimited(limited bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if limited && !d.limited {
+		d.warnf("Transmission time limit activated")
+		d.limited = true
+		d.limitReleased = make(chan struct{})
+	} else if !limited && d.limited {
+		d.warnf("Transmission time limit released")
+		d.limited = false
+		close(d.limitReleased)
+	}
+}
+
+// syncTransmitLimit はSFBを読んで送信総和時間の制限状態を合わせる
+// プロセスの起動前から制限中だった場合はEVENT 32が届かないので、これで補う
+func (d *Device) syncTransmitLimit(ctx context.Context, opts ...Option) (limited bool, err error) {
+	if limited, err = d.getRegisterBool(ctx, RegTransmitLimited, opts...); err != nil {
+		return
+	}
+	d.setTransmitLimited(limited)
+	return
+}
+
+// sendToError はSKSENDTOがFAIL ER10で失敗したとき、送信総和時間の制限中であればErrTransmitLimitedに置き換える
+// 制限中のSKSENDTOはEVENT 32なしでER10になることがある
+func (d *Device) sendToError(ctx context.Context, err error, opts ...Option) error {
+	var skErr *SKError
+	if !errors.As(err, &skErr) || skErr.Code != ErrCodeExecFailed {
+		return err
+	}
+	if limited, e := d.syncTransmitLimit(ctx, opts...); e == nil && limited {
+		return ErrTransmitLimited
+	}
+	return err
+}
+
+// waitTransmitLimit は送信総和時間の制限中であれば、WaitTransmitLimit()の指定に従って
+// 解除まで待つかErrTransmitLimitedを返す
+func (d *Device) waitTransmitLimit(ctx context.Context) error {
+	d.mu.Lock()
+	limited, released := d.limited, d.limitReleased
+	d.mu.Unlock()
+	if !limited {
+		return nil
+	}
+	if !d.waitLimit {
+		return ErrTransmitLimited
+	}
+	d.infof("Waiting for transmission time limit to be released")
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.closed:
+		return ErrClosed
+	}
+}
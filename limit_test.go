@@ -0,0 +1,126 @@
+package smartmeter_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func waitTransmitLimited(t *testing.T, dev *smartmeter.Device, limited bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for dev.TransmitLimited() != limited {
+		if time.Now().After(deadline) {
+			t.Fatalf("TransmitLimited() differ: %v != %v", dev.TransmitLimited(), limited)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTransmitLimitFailFast(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.LimitTransmission(true)
+	waitTransmitLimited(t, dev, true)
+	_, err := dev.QueryEchonetLite(newInstantaneousPowerRequest())
+	if !errors.Is(err, smartmeter.ErrTransmitLimited) {
+		t.Errorf("QueryEchonetLite() should return ErrTransmitLimited: %v", err)
+	}
+	if n := countCommand(m, "SKSENDTO"); n != 0 {
+		t.Errorf("SKSENDTO should not be sent during transmission limit: %d", n)
+	}
+
+	m.LimitTransmission(false)
+	waitTransmitLimited(t, dev, false)
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Errorf("QueryEchonetLite() error after EVENT 33: %v", err)
+	}
+}
+
+func TestTransmitLimitWait(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.WaitTransmitLimit(true))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.LimitTransmission(true)
+	waitTransmitLimited(t, dev, true)
+	time.AfterFunc(100*time.Millisecond, func() { m.LimitTransmission(false) })
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Errorf("QueryEchonetLite() should resume after EVENT 33: %v", err)
+	}
+}
+
+func TestTransmitLimitDuringQuery(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.Inject(sktest.Fault{
+		Command: "SKSENDTO",
+		Lines:   []string{"EVENT 32 " + m.IPAddr(), sktest.FailLine(10)},
+	})
+	_, err := dev.QueryEchonetLite(newInstantaneousPowerRequest(), smartmeter.Retry(3))
+	if !errors.Is(err, smartmeter.ErrTransmitLimited) {
+		t.Errorf("QueryEchonetLite() should return ErrTransmitLimited: %v", err)
+	}
+}
+
+func TestTransmitLimitAtOpen(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	// プロセスの起動前から制限中で、EVENT 32は届かない
+	m.SetRegister("SFB", "1")
+	dev := newTestDevice(t, m, smartmeter.WaitTransmitLimit(true))
+	if !dev.TransmitLimited() {
+		t.Fatalf("TransmitLimited() should be true at open")
+	}
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { m.LimitTransmission(false) })
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Errorf("QueryEchonetLite() should resume after EVENT 33: %v", err)
+	}
+	if n := countCommand(m, "SKSENDTO"); n != 1 {
+		t.Errorf("SKSENDTO should be sent once after release: %d", n)
+	}
+}
+
+func TestTransmitLimitER10(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	// EVENT 32を取りこぼしても、SKSENDTOのER10とSFBから制限中と分かる
+	m.SetRegister("SFB", "1")
+	_, err := dev.QueryEchonetLite(newInstantaneousPowerRequest())
+	if !errors.Is(err, smartmeter.ErrTransmitLimited) {
+		t.Errorf("QueryEchonetLite() should return ErrTransmitLimited: %v", err)
+	}
+	if !dev.TransmitLimited() {
+		t.Errorf("TransmitLimited() should be true after ER10")
+	}
+}
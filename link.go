@@ -0,0 +1,62 @@
+package smartmeter
+
+import (
+	"time"
+)
+
+// linkQualityWindow はLinkQuality()の統計に使う直近の受信数
+const linkQualityWindow = 32
+
+// LinkQuality はスマートメーターからの受信品質の統計
+// ERXUDPのLQI（デュアルスタックモジュールなど）と、スキャンで選んだPANのEPANDESCのLQIから集計する
+type LinkQuality struct {
+	Samples  int       // 統計に使った受信数。0なら他の値は意味を持たない
+	LQI      int       // 直近の受信ED値
+	RSSI     float64   // 直近の受信信号強度[dBm]
+	MinRSSI  float64   // 直近の受信の中で最小の受信信号強度[dBm]
+	MaxRSSI  float64   // 直近の受信の中で最大の受信信号強度[dBm]
+	MeanRSSI float64   // 直近の受信の受信信号強度の平均[dBm]
+	Updated  time.Time // 直近の受信時刻
+}
+
+// LinkQuality は直近の受信品質の統計を返す
+// 電波状況の悪化を、要求が失敗し始める前に検知するのに使う
+func (d *Device) LinkQuality() (q LinkQuality) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q.Samples = len(d.lqis)
+	if q.Samples == 0 {
+		return
+	}
+	q.LQI = d.lqiLast
+	q.RSSI = lqiToRSSI(q.LQI)
+	q.MinRSSI, q.MaxRSSI = q.RSSI, q.RSSI
+	var sum float64
+	for _, lqi := range d.lqis {
+		rssi := lqiToRSSI(lqi)
+		if rssi < q.MinRSSI {
+			q.MinRSSI = rssi
+		}
+		if rssi > q.MaxRSSI {
+			q.MaxRSSI = rssi
+		}
+		sum += rssi
+	}
+	q.MeanRSSI = sum / float64(q.Samples)
+	q.Updated = d.lqiUpdated
+	return
+}
+
+// recordLinkQuality は受信したLQIを統計に加える
+func (d *Device) recordLinkQuality(lqi int, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.lqis) < linkQualityWindow {
+		d.lqis = append(d.lqis, lqi)
+	} else {
+		d.lqis[d.lqiNext] = lqi
+	}
+	d.lqiNext = (d.lqiNext + 1) % linkQualityWindow
+	d.lqiLast = lqi
+	d.lqiUpdated = t
+}
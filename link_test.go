@@ -0,0 +1,45 @@
+package smartmeter_test
+
+import (
+	"testing"
+
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestLinkQuality(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	m.Meter.LQI = 0xA0
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	if q := dev.LinkQuality(); q.Samples != 0 {
+		t.Errorf("LinkQuality() should be empty before scan: %+v", q)
+	}
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	// スキャンで選んだPANのLQI
+	if q := dev.LinkQuality(); q.Samples != 1 || q.LQI != 0xA0 {
+		t.Errorf("LinkQuality() after scan differ: %+v", q)
+	}
+
+	m.Meter.LQI = 0x80
+	res, err := dev.QueryEchonetLite(newInstantaneousPowerRequest())
+	if err != nil {
+		t.Fatalf("QueryEchonetLite() error: %v", err)
+	}
+	p := res.Packet
+	if p == nil || !p.HasLQI || p.LQI != 0x80 || !p.Secured || p.Src.String() != "fe80::21c:6400:30c:12a4" || p.Time.IsZero() {
+		t.Fatalf("Unexpected receive metadata: %+v", p)
+	}
+
+	q := dev.LinkQuality()
+	if q.Samples != 2 || q.LQI != 0x80 || q.RSSI != p.RSSI() {
+		t.Errorf("LinkQuality() differ: %+v", q)
+	}
+	if q.MinRSSI != p.RSSI() || q.MaxRSSI <= q.MinRSSI || q.MeanRSSI <= q.MinRSSI || q.MeanRSSI >= q.MaxRSSI {
+		t.Errorf("LinkQuality() statistics differ: %+v", q)
+	}
+}
@@ -0,0 +1,101 @@
+package smartmeter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ModuleVersion はWi-SUNモジュールのファームウェアのバージョン
+type ModuleVersion struct {
+	Major int    // SKVERのメジャーバージョン
+	Minor int    // SKVERのマイナーバージョン
+	Patch int    // SKVERのリビジョン
+	App   string // SKAPPVERのアプリケーションバージョン。未対応のモジュールでは空
+}
+
+func (v ModuleVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.App != "" {
+		s += " (" + v.App + ")"
+	}
+	return s
+}
+
+// Compare はSKVERのバージョンを比較し、vがwより古ければ-1、同じなら0、新しければ1を返す
+func (v ModuleVersion) Compare(w ModuleVersion) int {
+	a := []int{v.Major, v.Minor, v.Patch}
+	b := []int{w.Major, w.Minor, w.Patch}
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast はSKVERのバージョンが指定したバージョン以上か返す
+func (v ModuleVersion) AtLeast(major, minor, patch int) bool {
+	return v.Compare(ModuleVersion{Major: major, Minor: minor, Patch: patch}) >= 0
+}
+
+// parseModuleVersion はEVERの値（例: 1.2.10）を解析する
+func parseModuleVersion(s string) (v ModuleVersion, err error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		err = fmt.Errorf("Unexpected version format: %s", s)
+		return
+	}
+	nums := make([]int, 3)
+	for i, part := range parts {
+		if nums[i], err = strconv.Atoi(part); err != nil {
+			err = fmt.Errorf("Unexpected version format: %s", s)
+			return
+		}
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return
+}
+
+// ModuleInfo はSKINFOで得られるWi-SUNモジュール自身の情報
+type ModuleInfo struct {
+	IPAddr    net.IP           // 自端末のIPv6リンクローカルアドレス
+	MAC       net.HardwareAddr // 自端末のMACアドレス（64bit）
+	Channel   int              // 使用中の論理チャンネル番号
+	PANID     uint16           // 使用中のPAN ID
+	Addr16    uint16           // 自端末のショートアドレス
+	DualStack bool             // デュアルスタックモジュールか（EINFOにSIDEが付く）
+}
+
+func (info ModuleInfo) String() string {
+	return fmt.Sprintf("IPAddr:%s MAC:%s Channel:%02X PANID:%04X Addr16:%04X", info.IPAddr, info.MAC, info.Channel, info.PANID, info.Addr16)
+}
+
+// parseModuleInfo はEINFOの値を解析する
+// 書式: <IPADDR> <ADDR64> <CHANNEL> <PANID> <ADDR16> [<SIDE>]
+func parseModuleInfo(s string) (info ModuleInfo, err error) {
+	fields := strings.Fields(s)
+	if len(fields) < 5 {
+		err = fmt.Errorf("Unexpected EINFO format: %s", s)
+		return
+	}
+	info.IPAddr = net.ParseIP(fields[0])
+	mac, err1 := hex.DecodeString(fields[1])
+	channel, err2 := strconv.ParseUint(fields[2], 16, 8)
+	panID, err3 := strconv.ParseUint(fields[3], 16, 16)
+	addr16, err4 := strconv.ParseUint(fields[4], 16, 16)
+	if info.IPAddr == nil || err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		err = fmt.Errorf("Unexpected EINFO format: %s", s)
+		return
+	}
+	info.MAC = net.HardwareAddr(mac)
+	info.Channel = int(channel)
+	info.PANID = uint16(panID)
+	info.Addr16 = uint16(addr16)
+	info.DualStack = len(fields) > 5
+	return
+}
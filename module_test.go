@@ -0,0 +1,82 @@
+package smartmeter
+
+import (
+	"testing"
+)
+
+func TestParseModuleVersion(t *testing.T) {
+	v, err := parseModuleVersion("1.2.10")
+	if err != nil {
+		t.Fatalf("parseModuleVersion() error: %v", err)
+	}
+	if v.Major != 1 || v.Minor != 2 || v.Patch != 10 {
+		t.Errorf("Unexpected version: %+v", v)
+	}
+	if v.Compare(ModuleVersion{Major: 1, Minor: 2, Patch: 9}) != 1 || v.Compare(ModuleVersion{Major: 1, Minor: 10}) != -1 || v.Compare(v) != 0 {
+		t.Errorf("Compare() returned wrong result for %s", v)
+	}
+	for _, s := range []string{"", "1", "1.x.0", "1.2.3.4"} {
+		if _, err := parseModuleVersion(s); err == nil {
+			t.Errorf("parseModuleVersion(%q) should fail", s)
+		}
+	}
+}
+
+func TestParseModuleInfo(t *testing.T) {
+	info, err := parseModuleInfo("FE80:0000:0000:0000:021D:1290:1234:5678 001D129012345678 21 8888 FFFE 0")
+	if err != nil {
+		t.Fatalf("parseModuleInfo() error: %v", err)
+	}
+	if info.Channel != 0x21 || info.PANID != 0x8888 || info.Addr16 != 0xFFFE || !info.DualStack {
+		t.Errorf("Unexpected module info: %+v", info)
+	}
+	if _, err := parseModuleInfo("FE80:0000:0000:0000:021D:1290:1234:5678 001D129012345678 21"); err == nil {
+		t.Errorf("parseModuleInfo() should fail on short line")
+	}
+}
+
+func TestRegisterProfile(t *testing.T) {
+	profilesMu.Lock()
+	saved := profiles
+	profilesMu.Unlock()
+	t.Cleanup(func() {
+		profilesMu.Lock()
+		profiles = saved
+		profilesMu.Unlock()
+	})
+
+	custom := &SKStackProfile{Model: "Custom", AppPrefix: "custom"}
+	RegisterProfile(custom)
+	if p := DetectProfile(ModuleVersion{App: "custom-1"}, ModuleInfo{}); p != custom {
+		t.Errorf("DetectProfile() differ: %q != %q", p.Name(), "Custom")
+	}
+	if p := DetectProfile(ModuleVersion{App: "rev26e"}, ModuleInfo{}); p != ProfileBP35A1 {
+		t.Errorf("DetectProfile() differ: %q != %q", p.Name(), "BP35A1")
+	}
+}
+
+func TestProfileCommands(t *testing.T) {
+	tests := []struct {
+		profile *SKStackProfile
+		scan    string
+		sendto  string
+	}{
+		{ProfileBP35A1, "SKSCAN 2 00001000 6", "SKSENDTO 1 FE80::1 0E1A 1 0002 ab"},
+		{ProfileBP35C0, "SKSCAN 2 00001000 6 0", "SKSENDTO 1 FE80::1 0E1A 1 0 0002 ab"},
+	}
+	for _, tt := range tests {
+		if cmd := tt.profile.ScanCommand(2, 0x1000, 6); cmd != tt.scan {
+			t.Errorf("ScanCommand() differ: %q != %q", cmd, tt.scan)
+		}
+		if cmd := tt.profile.SendToCommand(1, "FE80::1", 3610, 1, 0, []byte("ab")); cmd != tt.sendto {
+			t.Errorf("SendToCommand() differ: %q != %q", cmd, tt.sendto)
+		}
+	}
+
+	if _, err := ProfileBP35C0.ParseEvent("EVENT 21 FE80:0000:0000:0000:021C:6400:030C:12A4 0 00"); err != nil {
+		t.Errorf("ParseEvent() error: %v", err)
+	}
+	if _, err := ProfileBP35A1.ParseEvent("EVENT 21 FE80:0000:0000:0000:021C:6400:030C:12A4 0 00"); err == nil {
+		t.Errorf("ParseEvent() should fail for dual stack line on BP35A1")
+	}
+}
@@ -1,12 +1,16 @@
 // Functional Option Patternによるオプション指定
 // Deviceとqueryの両方共通で使うためにfunc(interface{})になっている
 // Deviceで指定したオプションは全queryに引き継がれる
+// Open()ではシリアルポートの設定（*serial.Config）にも適用される
 
 package smartmeter
 
 import (
+	"errors"
 	"log"
 	"time"
+
+	"github.com/tarm/serial"
 )
 
 type Option func(interface{}) error
@@ -47,10 +51,174 @@ func IPAddr(ipAddr string) Option {
 	}
 }
 
+// DualStackSK はデュアルスタックモジュールかどうかを指定する
+// trueならBP35C0、falseならBP35A1のModuleProfileを使い、Open()時の自動判別を行わない
+// 自動判別はSKINFOの<SIDE>の有無に頼るので、判別を誤る場合はこれで明示する
 func DualStackSK(v bool) Option {
 	return func(tgt interface{}) error {
 		if d, ok := tgt.(*Device); ok {
 			d.DualStackSK = v
+			d.profile = ProfileBP35A1
+			if v {
+				d.profile = ProfileBP35C0
+			}
+		}
+		return nil
+	}
+}
+
+// Profile は使用するModuleProfileを指定し、Open()時の自動判別を行わない
+func Profile(p ModuleProfile) Option {
+	return func(tgt interface{}) error {
+		if p == nil {
+			return errors.New("Module profile must not be nil")
+		}
+		if d, ok := tgt.(*Device); ok {
+			d.profile = p
+			d.DualStackSK = p.DualStack()
+		}
+		return nil
+	}
+}
+
+// ScanDurations はScan()のスキャン時間（SKSCANのDURATION、0〜14）を指定する
+// 複数指定すると、PANが見つかるまで順にスキャン時間を延ばしてスキャンを繰り返す
+// 指定しなければ4, 6, 8の順にスキャンする。以前のように1回だけスキャンするにはScanDurations(7)を指定する
+func ScanDurations(durations ...int) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.scanDurations = durations
+		}
+		return nil
+	}
+}
+
+// ScanChannelMask はScan()でスキャンするチャンネルをビットマスクで指定する（bit0がチャンネル0x21）
+// 指定しなければChannelで指定したチャンネルのみ、Channelも未指定なら全チャンネルをスキャンする
+func ScanChannelMask(mask uint32) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.scanChannelMask = mask
+		}
+		return nil
+	}
+}
+
+// ScanBudget はScan()にかける時間の上限を指定する
+// 指定した場合、PANが見つかるか上限に達するまで、ScanDurations()の最後のスキャン時間でスキャンを繰り返す
+func ScanBudget(budget time.Duration) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.scanBudget = budget
+		}
+		return nil
+	}
+}
+
+// ScanProgressFunc はScan()の進捗（Beacon受信と各スキャンの完了）を受け取るコールバックを指定する
+// コールバックはSKSCANの実行中にそのクエリの中から呼ばれるので、DeviceのSKコマンドを使うメソッドを呼ぶとデッドロックする
+// 時間のかかる処理や他のクエリは、goroutineやチャンネルに渡してから行うこと
+func ScanProgressFunc(fn func(ScanProgress)) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.scanProgress = fn
+		}
+		return nil
+	}
+}
+
+// Store は接続先の情報の保存先を指定する
+// 指定するとAuthenticate()は保存された接続先への直接Joinを先に試すので、再起動時のスキャンを省略できる
+func Store(store SessionStore) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.store = store
+		}
+		return nil
+	}
+}
+
+// SessionFile は接続先の情報をJSONファイルに保存する（Store(NewFileSessionStore(path))と同じ）
+func SessionFile(path string) Option {
+	return Store(NewFileSessionStore(path))
+}
+
+// SelectPAN はスキャンで複数のPANが見つかったときの接続先の選び方を指定する
+// StrongestPAN, PANWithPairID()または任意の関数を指定できる
+func SelectPAN(selector PANSelector) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.panSelector = selector
+		}
+		return nil
+	}
+}
+
+// AutoReauth はPANAセッションが切れていた場合の自動再接続の方針を指定する
+func AutoReauth(policy ReauthPolicy) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.reauthPolicy = policy
+		}
+		return nil
+	}
+}
+
+// WaitTransmitLimit は送信総和時間の制限中（EVENT 32〜33）にECHONET Liteの要求を送ろうとしたとき、
+// ErrTransmitLimitedを返さずに制限の解除まで待つかどうかを指定する
+func WaitTransmitLimit(v bool) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.waitLimit = v
+		}
+		return nil
+	}
+}
+
+// Display はERXUDPやERXTCPのデータ部の表示形式を指定する
+// Open()の時点でモジュールの設定（ROPT）と異なればWOPTで書き換える。WOPTはフラッシュに書き込まれ、
+// 書き換え回数には上限があるので、表示形式が一定しないモジュールを使う場合だけ指定すること
+// 指定しなければモジュールの設定に従い、WOPTは送らない
+// WOPT/ROPTに対応していないモジュールでModuleProfileのデフォルトと異なる形式を指定すると、Open()がエラーを返す
+func Display(mode DisplayMode) Option {
+	return func(tgt interface{}) error {
+		if d, ok := tgt.(*Device); ok {
+			d.wantDisplay = &mode
+		}
+		return nil
+	}
+}
+
+// BaudRate はOpen()で開くシリアルポートの通信速度を指定する
+func BaudRate(baud int) Option {
+	return func(tgt interface{}) error {
+		if c, ok := tgt.(*serial.Config); ok {
+			c.Baud = baud
+		}
+		return nil
+	}
+}
+
+// Parity はOpen()で開くシリアルポートのパリティを指定する
+func Parity(parity serial.Parity) Option {
+	return func(tgt interface{}) error {
+		if c, ok := tgt.(*serial.Config); ok {
+			c.Parity = parity
+		}
+		return nil
+	}
+}
+
+// ReadTimeout はOpen()で開くシリアルポートの読み込みタイムアウトを指定する
+// タイムアウトで返る(0, io.EOF)は読み込みエラーとせず、Close()されるまで読み直す
+// NewDevice()に渡した場合も、io.ReadWriteCloserが同じ振る舞いをするものとして扱う
+func ReadTimeout(timeout time.Duration) Option {
+	return func(tgt interface{}) error {
+		switch v := tgt.(type) {
+		case *serial.Config:
+			v.ReadTimeout = timeout
+		case *Device:
+			v.readTimeout = timeout
 		}
 		return nil
 	}
@@ -65,6 +233,16 @@ func Retry(count int) Option {
 	}
 }
 
+// RetryOn は指定したエラーコードのSKErrorをリトライ可能なエラーとして扱う
+func RetryOn(codes ...SKErrorCode) Option {
+	return func(tgt interface{}) error {
+		if q, ok := tgt.(*query); ok {
+			q.retryOn = append(q.retryOn, codes...)
+		}
+		return nil
+	}
+}
+
 func RetryInterval(d time.Duration) Option {
 	return func(tgt interface{}) error {
 		if q, ok := tgt.(*query); ok {
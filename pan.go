@@ -0,0 +1,155 @@
+package smartmeter
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrPANNotFound はスキャンでPANが見つからなかったときに返る
+var ErrPANNotFound = errors.New("No PAN found")
+
+// PANDescriptor はアクティブスキャンで見つかったPAN（EPANDESC）に対応する構造体
+type PANDescriptor struct {
+	Channel     int              // 論理チャンネル番号（0x21〜0x3C）
+	ChannelPage int              // チャンネルページ
+	PanID       uint16           // PAN ID
+	MACAddr     net.HardwareAddr // アクセス元（スマートメーター）のMACアドレス（64bit）
+	LQI         int              // 受信したビーコンの受信ED値
+	PairID      string           // 相手から受信したPairing ID（16進8桁）。無い場合は空
+}
+
+// RSSI はLQIから換算した受信信号強度[dBm]を返す
+func (p PANDescriptor) RSSI() float64 {
+	return lqiToRSSI(p.LQI)
+}
+
+func (p PANDescriptor) String() string {
+	s := fmt.Sprintf("Channel:%02X PanID:%04X Addr:%X LQI:%d (%.1fdBm)", p.Channel, p.PanID, []byte(p.MACAddr), p.LQI, p.RSSI())
+	if p.PairID != "" {
+		s += " PairID:" + p.PairID
+	}
+	return s
+}
+
+// lqiToRSSI はLQIを受信信号強度[dBm]に換算する（BP35A1のコマンドリファレンス記載の換算式）
+func lqiToRSSI(lqi int) float64 {
+	return 0.275*float64(lqi) - 104.27
+}
+
+// PANSelector はスキャンで見つかった複数のPANから接続先を選ぶ関数
+type PANSelector func(pans []PANDescriptor) (PANDescriptor, error)
+
+// StrongestPAN はLQIが最も大きいPANを選ぶ
+func StrongestPAN(pans []PANDescriptor) (PANDescriptor, error) {
+	if len(pans) == 0 {
+		return PANDescriptor{}, ErrPANNotFound
+	}
+	best := pans[0]
+	for _, p := range pans[1:] {
+		if p.LQI > best.LQI {
+			best = p
+		}
+	}
+	return best, nil
+}
+
+// PANWithPairID はPairing IDが一致するPANを選ぶPANSelectorを返す
+// 一致するものが複数あればLQIが最も大きいものを選ぶ
+func PANWithPairID(pairID string) PANSelector {
+	return func(pans []PANDescriptor) (PANDescriptor, error) {
+		var matched []PANDescriptor
+		for _, p := range pans {
+			if strings.EqualFold(p.PairID, pairID) {
+				matched = append(matched, p)
+			}
+		}
+		if len(matched) == 0 {
+			return PANDescriptor{}, fmt.Errorf("%w (PairID: %s)", ErrPANNotFound, pairID)
+		}
+		return StrongestPAN(matched)
+	}
+}
+
+// selectPAN はSelectPAN()で指定したPANSelectorで接続先を選ぶ
+// 指定がなければ、Bルート認証IDの下8桁とPairing IDが一致するPANを優先し、その中でLQIが最も大きいものを選ぶ
+func (d *Device) selectPAN(pans []PANDescriptor) (PANDescriptor, error) {
+	if d.panSelector != nil {
+		return d.panSelector(pans)
+	}
+	if len(d.ID) >= 8 {
+		if p, err := PANWithPairID(d.ID[len(d.ID)-8:])(pans); err == nil {
+			return p, nil
+		}
+	}
+	return StrongestPAN(pans)
+}
+
+// parsePANDescriptors はSKSCANのレスポンスからEPANDESCを全て取り出す
+func (d *Device) parsePANDescriptors(res string) (pans []PANDescriptor) {
+	var cur *PANDescriptor
+	var fields int
+	flush := func() {
+		// Channel, Pan ID, Addrが揃っていないものは捨てる
+		if cur != nil {
+			if fields&7 == 7 {
+				pans = append(pans, *cur)
+			} else {
+				d.warnf("Incomplete EPANDESC ignored: %+v", *cur)
+			}
+		}
+		cur = nil
+		fields = 0
+	}
+	for _, line := range strings.Split(res, "\n") {
+		if line == "EPANDESC" {
+			flush()
+			cur = &PANDescriptor{}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if !strings.HasPrefix(line, "  ") {
+			flush()
+			continue
+		}
+		kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "Channel":
+			if v, err := strconv.ParseUint(value, 16, 8); err == nil {
+				cur.Channel = int(v)
+				fields |= 1
+			}
+		case "Channel Page":
+			if v, err := strconv.ParseUint(value, 16, 8); err == nil {
+				cur.ChannelPage = int(v)
+			}
+		case "Pan ID":
+			if v, err := strconv.ParseUint(value, 16, 16); err == nil {
+				cur.PanID = uint16(v)
+				fields |= 2
+			}
+		case "Addr":
+			if v, err := hex.DecodeString(value); err == nil && len(v) == 8 {
+				cur.MACAddr = net.HardwareAddr(v)
+				fields |= 4
+			}
+		case "LQI":
+			if v, err := strconv.ParseUint(value, 16, 8); err == nil {
+				cur.LQI = int(v)
+			}
+		case "PairID":
+			cur.PairID = value
+		}
+	}
+	flush()
+	return
+}
@@ -0,0 +1,61 @@
+package smartmeter
+
+import (
+	"testing"
+)
+
+func TestParsePANDescriptors(t *testing.T) {
+	res := `
+OK
+EVENT 20 FE80:0000:0000:0000:021C:6400:030C:12A4
+EPANDESC
+  Channel:33
+  Channel Page:09
+  Pan ID:8888
+  Addr:001C6400030C12A4
+  LQI:E1
+  PairID:00112233
+EVENT 20 FE80:0000:0000:0000:021C:6400:030C:9999
+EPANDESC
+  Channel:3B
+  Channel Page:09
+  Addr:001C6400030C9999
+  LQI:40
+EPANDESC
+  Channel:21
+  Channel Page:09
+  Pan ID:1234
+  Addr:001C640003AB0001
+  LQI:F0
+EVENT 22 FE80:0000:0000:0000:021D:1290:1234:5678`
+
+	d := &Device{}
+	pans := d.parsePANDescriptors(res)
+	if len(pans) != 2 {
+		t.Fatalf("Number of PANs differ: %d != 2: %+v", len(pans), pans)
+	}
+	p := pans[0]
+	if p.Channel != 0x33 || p.ChannelPage != 9 || p.PanID != 0x8888 || p.LQI != 0xE1 || p.PairID != "00112233" {
+		t.Errorf("Unexpected PAN descriptor: %+v", p)
+	}
+	if p.MACAddr.String() != "00:1c:64:00:03:0c:12:a4" {
+		t.Errorf("MAC address differ: %v", p.MACAddr)
+	}
+
+	best, err := StrongestPAN(pans)
+	if err != nil || best.PanID != 0x1234 {
+		t.Errorf("StrongestPAN() selected wrong PAN: %+v, %v", best, err)
+	}
+	paired, err := PANWithPairID("00112233")(pans)
+	if err != nil || paired.PanID != 0x8888 {
+		t.Errorf("PANWithPairID() selected wrong PAN: %+v, %v", paired, err)
+	}
+	if _, err := PANWithPairID("FFFFFFFF")(pans); err == nil {
+		t.Errorf("PANWithPairID() should fail when no PAN matches")
+	}
+
+	d.ID = "0000000000000000000000AA00112233"
+	if p, _ := d.selectPAN(pans); p.PanID != 0x8888 {
+		t.Errorf("selectPAN() should prefer PAN matching the ID: %+v", p)
+	}
+}
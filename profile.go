@@ -0,0 +1,197 @@
+package smartmeter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Feature はモジュールが対応している機能
+type Feature uint
+
+const (
+	FeatureHAN           Feature = 1 << iota // HAN側のインターフェース（SIDE 1）で送受信できる
+	FeatureTCP                               // SKCONNECT, SKSEND, SKCLOSEでTCP通信できる
+	FeatureRejoin                            // SKREJOINでPANA認証をやり直せる
+	FeatureDisplayOption                     // WOPT/ROPTで表示形式を切り替えられる
+)
+
+// ModuleProfile はWi-SUNモジュールの製品ごとの違いを表す
+// コマンドとイベントの書式、表示形式のデフォルト、対応している機能を返す
+// RegisterProfile()で登録すると、Open()時の自動判別の対象になる
+type ModuleProfile interface {
+	// Name は製品名を返す
+	Name() string
+	// Match はSKVER/SKAPPVERとSKINFOの結果がこの製品のものか判定する
+	Match(v ModuleVersion, info ModuleInfo) bool
+	// DualStack はSKSCANやSKSENDTOにSIDEを指定するデュアルスタックモジュールか返す
+	DualStack() bool
+	// DefaultDisplayMode はWOPT/ROPTに対応していない場合の表示形式を返す
+	DefaultDisplayMode() DisplayMode
+	// Supports は指定した機能に対応しているか返す
+	Supports(f Feature) bool
+	// ScanCommand はSKSCANコマンドを作る
+	ScanCommand(mode int, mask uint32, duration int) string
+	// SendToCommand はSKSENDTOコマンドを作る。データはバイナリのまま末尾に付ける
+	SendToCommand(handle int, ipAddr string, port uint16, sec int, side int, data []byte) string
+	// ParseEvent はEVENT行を解釈する
+	ParseEvent(line string) (Event, error)
+	// ParseUDP はERXUDP行を解釈する。<DATA>はmodeの表示形式で解釈する
+	ParseUDP(line string, mode DisplayMode) (*UDPPacket, error)
+}
+
+// SKStackProfile はSKSTACK-IPの標準的なコマンド書式に従うモジュールのModuleProfile
+// フィールドを埋めるだけで新しい製品に対応できる
+type SKStackProfile struct {
+	Model     string      // 製品名
+	AppPrefix string      // SKAPPVERの応答がこれで始まる製品に一致する。空なら応答を問わない
+	Dual      bool        // デュアルスタックモジュールか。SKINFOのSIDEの有無と照合する
+	Display   DisplayMode // WOPT/ROPTに対応していない場合の表示形式
+	Features  Feature     // 対応している機能
+}
+
+func (p *SKStackProfile) Name() string {
+	return p.Model
+}
+
+func (p *SKStackProfile) Match(v ModuleVersion, info ModuleInfo) bool {
+	if p.AppPrefix != "" && !strings.HasPrefix(v.App, p.AppPrefix) {
+		return false
+	}
+	return p.Dual == info.DualStack
+}
+
+func (p *SKStackProfile) DualStack() bool {
+	return p.Dual
+}
+
+func (p *SKStackProfile) DefaultDisplayMode() DisplayMode {
+	return p.Display
+}
+
+func (p *SKStackProfile) Supports(f Feature) bool {
+	return p.Features&f == f
+}
+
+// ScanCommand の書式: SKSCAN <MODE> <CHANNEL_MASK> <DURATION> [<SIDE>]
+func (p *SKStackProfile) ScanCommand(mode int, mask uint32, duration int) string {
+	cmd := fmt.Sprintf("SKSCAN %d %08X %X", mode, mask, duration)
+	if p.Dual {
+		cmd = cmd + " 0"
+	}
+	return cmd
+}
+
+// SendToCommand の書式: SKSENDTO <HANDLE> <IPADDR> <PORT> <SEC> [<SIDE>] <DATALEN> <DATA>
+func (p *SKStackProfile) SendToCommand(handle int, ipAddr string, port uint16, sec int, side int, data []byte) string {
+	if p.Dual {
+		return fmt.Sprintf("SKSENDTO %d %s %04X %d %d %04X %s", handle, ipAddr, port, sec, side, len(data), data)
+	}
+	return fmt.Sprintf("SKSENDTO %d %s %04X %d %04X %s", handle, ipAddr, port, sec, len(data), data)
+}
+
+// ParseEvent の書式: EVENT <NUM> <SENDER> [<SIDE>] [<PARAM>]（<SIDE>はデュアルスタックモジュールのみ）
+func (p *SKStackProfile) ParseEvent(line string) (Event, error) {
+	return parseEvent(line, p.Dual)
+}
+
+// ParseUDP の書式: ERXUDP <SENDER> <DEST> <RPORT> <LPORT> <SENDERLLA> [<LQI>] <SECURED> [<SIDE>] <DATALEN> <DATA>
+// <SIDE>はデュアルスタックモジュールのみ。<LQI>もデュアルスタックモジュールのみで、ファームウェアによっては付かない
+func (p *SKStackProfile) ParseUDP(line string, mode DisplayMode) (*UDPPacket, error) {
+	return parseUDPPacket(line, mode, p.Dual)
+}
+
+var (
+	// ProfileBP35A1 はROHM BP35A1（Bルート専用）
+	ProfileBP35A1 = &SKStackProfile{Model: "BP35A1", AppPrefix: "rev", Features: FeatureTCP | FeatureRejoin | FeatureDisplayOption}
+	// ProfileBP35C0 はROHM BP35C0（Bルート/HANデュアルスタック）
+	ProfileBP35C0 = &SKStackProfile{Model: "BP35C0", AppPrefix: "rev", Dual: true, Features: FeatureHAN | FeatureTCP | FeatureRejoin | FeatureDisplayOption}
+	// ProfileRL7023 はテセラ・テクノロジー RL7023 Stick-D/IPS（Bルート専用）
+	ProfileRL7023 = &SKStackProfile{Model: "RL7023", AppPrefix: "RL7023", Features: FeatureRejoin}
+	// ProfileWSR35A1 はWSR35A1（Bルート専用）
+	ProfileWSR35A1 = &SKStackProfile{Model: "WSR35A1", AppPrefix: "WSR35A1", Features: FeatureRejoin}
+)
+
+var (
+	profilesMu sync.Mutex
+	profiles   = []ModuleProfile{ProfileBP35C0, ProfileBP35A1, ProfileRL7023, ProfileWSR35A1}
+)
+
+// RegisterProfile は自動判別の対象にModuleProfileを追加する
+// 後から登録したものほど優先して判定される
+func RegisterProfile(p ModuleProfile) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles = append([]ModuleProfile{p}, profiles...)
+}
+
+// DetectProfile はSKVER/SKAPPVERとSKINFOの結果に一致するModuleProfileを返す
+// どれにも一致しなければ、SKINFOのSIDEの有無に応じてBP35C0かBP35A1と同じ書式とみなす
+func DetectProfile(v ModuleVersion, info ModuleInfo) ModuleProfile {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	for _, p := range profiles {
+		if p.Match(v, info) {
+			return p
+		}
+	}
+	if info.DualStack {
+		return ProfileBP35C0
+	}
+	return ProfileBP35A1
+}
+
+// Profile はDeviceが使っているModuleProfileを返す。Open()の途中で判別する前はnil
+func (d *Device) Profile() ModuleProfile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.profile
+}
+
+// detectProfile はモジュールに問い合わせてModuleProfileを決める
+func (d *Device) detectProfile(ctx context.Context, opts ...Option) (err error) {
+	v, err := d.GetVersionContext(ctx, opts...)
+	if err != nil {
+		return
+	}
+	info, err := d.GetInfoContext(ctx, opts...)
+	if err != nil {
+		return
+	}
+	p := DetectProfile(v, info)
+	alt := info
+	alt.DualStack = !info.DualStack
+	d.mu.Lock()
+	d.profile = p
+	if a := DetectProfile(v, alt); a.DualStack() != p.DualStack() {
+		d.altProfile = a
+	}
+	d.mu.Unlock()
+	d.DualStackSK = p.DualStack()
+	d.infof("Module profile detected: %s (version %s)", p.Name(), v)
+	return
+}
+
+// fallbackProfile はusedの書式で作ったSKSCANやSKSENDTOがFAIL ER05（引数の数の誤り）で失敗したとき、
+// 自動判別で選ばなかったModuleProfileに切り替えてtrueを返す。呼び出し元はコマンドを作り直して送り直す
+// BP35A1とBP35C0はSKAPPVERが同じ形式で、SKINFOの<SIDE>の有無でしか区別できないため、その判別誤りを補う
+func (d *Device) fallbackProfile(used ModuleProfile, err error) bool {
+	var skErr *SKError
+	if !errors.As(err, &skErr) || skErr.Code != ErrCodeInvalidArgCount {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.profile != used {
+		// 他のクエリが既に切り替えた
+		return true
+	}
+	if d.altProfile == nil {
+		return false
+	}
+	d.warnf("%s rejected %s, switching module profile to %s", used.Name(), skErr.Command, d.altProfile.Name())
+	d.profile, d.altProfile = d.altProfile, nil
+	return true
+}
@@ -0,0 +1,157 @@
+package smartmeter_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestDetectProfile(t *testing.T) {
+	tests := []struct {
+		dualStack  bool
+		appVersion string
+		name       string
+		ropt       int
+	}{
+		{false, "rev26e", "BP35A1", 1},
+		{true, "rev26e", "BP35C0", 1},
+		{false, "RL7023-1.0.0", "RL7023", 0},
+		// SKAPPVERに対応していなければSKINFOのSIDEの有無で判断する
+		{false, "", "BP35A1", 1},
+		{true, "", "BP35C0", 1},
+	}
+	for _, tt := range tests {
+		m := sktest.NewModule()
+		m.DualStack = tt.dualStack
+		m.AppVersion = tt.appVersion
+		dev, err := smartmeter.NewDevice(m, smartmeter.Timeout(time.Second))
+		if err != nil {
+			t.Fatalf("NewDevice() error: %v", err)
+		}
+		if name := dev.Profile().Name(); name != tt.name {
+			t.Errorf("Profile differ: %q != %q", name, tt.name)
+		}
+		if dev.Profile().DualStack() != tt.dualStack {
+			t.Errorf("DualStack() differ for %s: %v != %v", tt.name, dev.Profile().DualStack(), tt.dualStack)
+		}
+		if n := countCommand(m, "ROPT"); n != tt.ropt {
+			t.Errorf("ROPT count differ for %s: %d != %d", tt.name, n, tt.ropt)
+		}
+		dev.Close()
+		m.Close()
+	}
+}
+
+func TestProfileOption(t *testing.T) {
+	m := sktest.NewModule()
+	defer m.Close()
+	dev, err := smartmeter.NewDevice(m, smartmeter.Profile(smartmeter.ProfileBP35A1), smartmeter.Timeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewDevice() error: %v", err)
+	}
+	defer dev.Close()
+	if name := dev.Profile().Name(); name != "BP35A1" {
+		t.Errorf("Profile differ: %q != %q", name, "BP35A1")
+	}
+	if n := countCommand(m, "SKVER"); n != 0 {
+		t.Errorf("SKVER should not be sent when the profile is specified: %d", n)
+	}
+
+	if _, err := smartmeter.NewDevice(m, smartmeter.Profile(nil)); err == nil {
+		t.Errorf("NewDevice() should fail with nil profile")
+	}
+}
+
+func TestNewDeviceContext(t *testing.T) {
+	m := sktest.NewModule()
+	defer m.Close()
+	// SKVERに応答しないモジュールでも、ctxで判別を打ち切れる
+	m.Inject(sktest.Fault{Command: "SKVER"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := smartmeter.NewDeviceContext(ctx, m); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("NewDeviceContext() should return context.DeadlineExceeded: %v", err)
+	}
+}
+
+func TestProfileFeatures(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	defer dev.Close()
+
+	dst := net.ParseIP("FE80::1")
+	if err := dev.SendUDP(1, dst, 3610, false, 1, []byte("ab")); err == nil {
+		t.Errorf("SendUDP() on HAN side should fail on BP35A1")
+	}
+
+	m2 := sktest.NewModule()
+	defer m2.Close()
+	noTCP := &smartmeter.SKStackProfile{Model: "NoTCP", Features: smartmeter.FeatureRejoin}
+	dev2, err := smartmeter.NewDevice(m2, smartmeter.Profile(noTCP), smartmeter.Timeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewDevice() error: %v", err)
+	}
+	defer dev2.Close()
+	if _, err := dev2.DialTCP(context.Background(), dst, 7); err == nil {
+		t.Errorf("DialTCP() should fail when the profile lacks FeatureTCP")
+	}
+}
+
+func TestProfileFallbackWithoutInfoSide(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	// EINFOに<SIDE>を出さないデュアルスタックモジュールはBP35A1と判別される
+	m.Inject(sktest.Fault{Command: "SKINFO", Lines: []string{
+		"EINFO " + m.IPAddr() + " " + m.MACAddr + " 21 FFFF FFFE",
+		"OK",
+	}})
+	dev, err := smartmeter.NewDevice(m,
+		smartmeter.ID(m.Meter.ID),
+		smartmeter.Password(m.Meter.Password),
+		smartmeter.Timeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewDevice() error: %v", err)
+	}
+	defer dev.Close()
+	if name := dev.Profile().Name(); name != "BP35A1" {
+		t.Fatalf("Profile differ: %q != %q", name, "BP35A1")
+	}
+
+	// SKSCANがFAIL ER05になったらBP35C0の書式で送り直す
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() should fall back to dual stack profile: %v", err)
+	}
+	if name := dev.Profile().Name(); name != "BP35C0" {
+		t.Errorf("Profile differ: %q != %q", name, "BP35C0")
+	}
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Errorf("QueryEchonetLite() error: %v", err)
+	}
+}
+
+func TestProfileNoFallbackWithExplicitProfile(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.DualStackSK(false))
+
+	// 明示したModuleProfileは切り替えない
+	var skErr *smartmeter.SKError
+	if _, err := dev.Scan(); !errors.As(err, &skErr) || skErr.Code != smartmeter.ErrCodeInvalidArgCount {
+		t.Errorf("Scan() should return ER05 with explicit profile: %v", err)
+	}
+	if name := dev.Profile().Name(); name != "BP35A1" {
+		t.Errorf("Profile differ: %q != %q", name, "BP35A1")
+	}
+}
@@ -1,8 +1,10 @@
 package smartmeter
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 	"time"
@@ -10,11 +12,13 @@ import (
 
 type query struct {
 	s             *Device
+	lines         chan string
 	command       string
 	retry         int
 	retryInterval time.Duration
 	timeout       time.Duration
 	reader        func(string) (bool, error)
+	retryOn       []SKErrorCode
 	logger        *log.Logger
 	verbosity     int
 }
@@ -44,41 +48,97 @@ func NewSKQuery(s *Device, command string, opts ...Option) (*query, error) {
 }
 
 func (q *query) Exec() (res string, err error) {
+	return q.ExecContext(context.Background())
+}
+
+// ExecContext はSKコマンドを実行する。リトライ可能なエラーの場合はretryの回数だけ再実行する
+// 複数goroutineから呼ばれた場合、リトライを含めて1クエリずつ順番に実行される
+func (q *query) ExecContext(ctx context.Context) (res string, err error) {
+	if err = q.s.acquire(ctx); err != nil {
+		return
+	}
+	defer q.s.release()
+	q.lines = q.s.attach()
+	defer q.s.detach()
+	for {
+		res, err = q.exec(ctx)
+		if err == nil || !q.isRetryable(err) {
+			return
+		}
+		q.retry--
+		if q.retry < 0 {
+			return
+		}
+		q.warnf("Ignorable error: %+v\n", err)
+		tm := time.NewTimer(q.retryInterval)
+		select {
+		case <-ctx.Done():
+			tm.Stop()
+			return "", ctx.Err()
+		case <-tm.C:
+		}
+	}
+}
+
+// isRetryable はリトライ可能なエラーか判定する
+// RetryOn()で指定したエラーコードのSKErrorもリトライ対象になる
+func (q *query) isRetryable(err error) bool {
+	if errors.Is(err, RetryableError) {
+		return true
+	}
+	var skErr *SKError
+	if errors.As(err, &skErr) {
+		for _, code := range q.retryOn {
+			if skErr.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *query) exec(ctx context.Context) (res string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = q.s.err(); err != nil {
+		return
+	}
 	q.debugf(">> %q\n", q.command)
 	_, err = q.s.writer.WriteString(q.command + "\r\n")
-	if err != nil {
-		return
+	if err == nil {
+		err = q.s.writer.Flush()
 	}
-	err = q.s.writer.Flush()
 	if err != nil {
+		if e := q.s.err(); e != nil {
+			err = e
+		}
 		return
 	}
 
 	tm := time.NewTimer(q.timeout)
+	defer tm.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-q.s.closed:
+			return "", ErrClosed
 		case <-tm.C:
-			return "", fmt.Errorf("SK command timeout (%dsec)", q.timeout/time.Second)
-		case line, ok := <-q.s.inputChan:
-			if !ok {
-				return "", errors.New("SK command read error")
+			return "", fmt.Errorf("%w (%dsec)", ErrTimeout, q.timeout/time.Second)
+		case <-q.s.done:
+			if err = q.s.err(); err == nil {
+				err = &ReadError{Err: io.ErrUnexpectedEOF}
 			}
+			return "", err
+		case line := <-q.lines:
 			q.debugf("<< %q\n", line)
 			if strings.HasPrefix(line, "FAIL ") {
-				return "", fmt.Errorf("SK command response error: %s", line)
+				return "", parseSKError(q.command, line)
 			}
 			var ret bool
 			ret, err = q.reader(line)
 			if err != nil {
-				if errors.Is(err, RetryableError) {
-					q.retry--
-					if q.retry >= 0 {
-						q.warnf("Ignorable error: %+v\n", err)
-						time.Sleep(q.retryInterval)
-						//本当はループにすべきなんだけど手抜きで再帰
-						return q.Exec()
-					}
-				}
 				return
 			}
 			res += "\n" + line
@@ -0,0 +1,361 @@
+package smartmeter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Register はSKSTACK-IPの仮想レジスタ名
+type Register string
+
+/*
+ * 参考資料
+ *   SKSTACK IP コマンドリファレンスマニュアル「仮想レジスタ一覧」
+ */
+
+const (
+	RegChannel         Register = "S02" // 使用する周波数の論理チャンネル番号（0x21-0x3C）
+	RegPANID           Register = "S03" // 使用するPAN ID
+	RegFrameCounter    Register = "S07" // MAC層のフレームカウンタ（読み込み専用）
+	RegPairingID       Register = "S0A" // ペアリングID（16進8桁）
+	RegBeaconResponse  Register = "S15" // ビーコン要求に応答するか
+	RegSessionLifetime Register = "S16" // PANAセッションのライフタイム（秒）
+	RegAutoReauth      Register = "S17" // ライフタイム経過前に自動で再認証するか
+	RegEncryption      Register = "SA0" // MAC層の暗号化を行うか
+	RegICMPNotify      Register = "SA1" // ICMPメッセージを通知するか
+	RegTransmitLimited Register = "SFB" // 送信総和時間の制限中か（読み込み専用）
+	RegTransmitTime    Register = "SFD" // 無線送信の積算時間（ミリ秒、読み込み専用）
+	RegEchoBack        Register = "SFE" // コマンドをエコーバックするか
+	RegAutoLoad        Register = "SFF" // 起動時にSKSAVEした設定を自動で読み込むか
+)
+
+// KnownRegisters はこのパッケージが型付きで扱える仮想レジスタの一覧
+var KnownRegisters = []Register{
+	RegChannel, RegPANID, RegFrameCounter, RegPairingID, RegBeaconResponse,
+	RegSessionLifetime, RegAutoReauth, RegEncryption, RegICMPNotify,
+	RegTransmitLimited, RegTransmitTime, RegEchoBack, RegAutoLoad,
+}
+
+var registerDescs = map[Register]string{
+	RegChannel:         "Logical channel number",
+	RegPANID:           "PAN ID",
+	RegFrameCounter:    "MAC frame counter",
+	RegPairingID:       "Pairing ID",
+	RegBeaconResponse:  "Beacon response flag",
+	RegSessionLifetime: "PANA session lifetime",
+	RegAutoReauth:      "PANA auto reauthentication flag",
+	RegEncryption:      "MAC encryption flag",
+	RegICMPNotify:      "ICMP notification flag",
+	RegTransmitLimited: "Transmission time limit flag",
+	RegTransmitTime:    "Accumulated transmission time",
+	RegEchoBack:        "Command echo back flag",
+	RegAutoLoad:        "Auto load flag",
+}
+
+// Desc はレジスタの説明を返す
+func (r Register) Desc() string {
+	if desc, ok := registerDescs[r]; ok {
+		return desc
+	}
+	return "unknown register"
+}
+
+// MinSessionLifetime はSetSessionLifetime()に指定できる最小値
+const MinSessionLifetime = 60 * time.Second
+
+// Registers はDumpRegisters()で読み出した仮想レジスタの値
+type Registers struct {
+	Channel         int           // S02
+	PANID           uint16        // S03
+	FrameCounter    uint32        // S07
+	PairingID       string        // S0A
+	BeaconResponse  bool          // S15
+	SessionLifetime time.Duration // S16
+	AutoReauth      bool          // S17
+	Encryption      bool          // SA0
+	ICMPNotify      bool          // SA1
+	TransmitLimited bool          // SFB
+	TransmitTime    time.Duration // SFD
+	EchoBack        bool          // SFE
+	AutoLoad        bool          // SFF
+}
+
+func (d *Device) getRegisterUint(ctx context.Context, reg Register, bitSize int, opts ...Option) (v uint64, err error) {
+	s, err := d.GetRegisterValueContext(ctx, string(reg), opts...)
+	if err != nil {
+		return
+	}
+	v, err = strconv.ParseUint(s, 16, bitSize)
+	if err != nil {
+		err = fmt.Errorf("Unexpected value for %s: %s", reg, s)
+	}
+	return
+}
+
+func (d *Device) getRegisterBool(ctx context.Context, reg Register, opts ...Option) (v bool, err error) {
+	n, err := d.getRegisterUint(ctx, reg, 8, opts...)
+	if err != nil {
+		return
+	}
+	if n > 1 {
+		return false, fmt.Errorf("Unexpected value for %s: %X", reg, n)
+	}
+	return n == 1, nil
+}
+
+func (d *Device) setRegisterBool(ctx context.Context, reg Register, v bool, opts ...Option) error {
+	s := "0"
+	if v {
+		s = "1"
+	}
+	return d.SetRegisterValueContext(ctx, string(reg), s, opts...)
+}
+
+func (d *Device) GetChannel(opts ...Option) (channel int, err error) {
+	return d.GetChannelContext(context.Background(), opts...)
+}
+
+// GetChannelContext は論理チャンネル番号（S02）を取得する
+func (d *Device) GetChannelContext(ctx context.Context, opts ...Option) (channel int, err error) {
+	v, err := d.getRegisterUint(ctx, RegChannel, 8, opts...)
+	return int(v), err
+}
+
+func (d *Device) SetChannel(channel int, opts ...Option) error {
+	return d.SetChannelContext(context.Background(), channel, opts...)
+}
+
+// SetChannelContext は論理チャンネル番号（S02）を設定する
+func (d *Device) SetChannelContext(ctx context.Context, channel int, opts ...Option) error {
+	if channel < 0x21 || channel > 0x3C {
+		return fmt.Errorf("Channel must be 21-3C: %X", channel)
+	}
+	return d.SetRegisterValueContext(ctx, string(RegChannel), fmt.Sprintf("%02X", channel), opts...)
+}
+
+func (d *Device) GetPANID(opts ...Option) (panID uint16, err error) {
+	return d.GetPANIDContext(context.Background(), opts...)
+}
+
+// GetPANIDContext はPAN ID（S03）を取得する
+func (d *Device) GetPANIDContext(ctx context.Context, opts ...Option) (panID uint16, err error) {
+	v, err := d.getRegisterUint(ctx, RegPANID, 16, opts...)
+	return uint16(v), err
+}
+
+func (d *Device) SetPANID(panID uint16, opts ...Option) error {
+	return d.SetPANIDContext(context.Background(), panID, opts...)
+}
+
+// SetPANIDContext はPAN ID（S03）を設定する
+func (d *Device) SetPANIDContext(ctx context.Context, panID uint16, opts ...Option) error {
+	return d.SetRegisterValueContext(ctx, string(RegPANID), fmt.Sprintf("%04X", panID), opts...)
+}
+
+func (d *Device) GetFrameCounter(opts ...Option) (counter uint32, err error) {
+	return d.GetFrameCounterContext(context.Background(), opts...)
+}
+
+// GetFrameCounterContext はMAC層のフレームカウンタ（S07）を取得する
+func (d *Device) GetFrameCounterContext(ctx context.Context, opts ...Option) (counter uint32, err error) {
+	v, err := d.getRegisterUint(ctx, RegFrameCounter, 32, opts...)
+	return uint32(v), err
+}
+
+func (d *Device) GetPairingID(opts ...Option) (pairingID string, err error) {
+	return d.GetPairingIDContext(context.Background(), opts...)
+}
+
+// GetPairingIDContext はペアリングID（S0A）を取得する
+func (d *Device) GetPairingIDContext(ctx context.Context, opts ...Option) (pairingID string, err error) {
+	return d.GetRegisterValueContext(ctx, string(RegPairingID), opts...)
+}
+
+func (d *Device) SetPairingID(pairingID string, opts ...Option) error {
+	return d.SetPairingIDContext(context.Background(), pairingID, opts...)
+}
+
+// SetPairingIDContext はペアリングID（S0A）を設定する
+// 通常はBルート認証IDの末尾8桁を指定する
+func (d *Device) SetPairingIDContext(ctx context.Context, pairingID string, opts ...Option) error {
+	if _, err := strconv.ParseUint(pairingID, 16, 32); err != nil || len(pairingID) != 8 {
+		return fmt.Errorf("Invalid pairing ID: %s", pairingID)
+	}
+	return d.SetRegisterValueContext(ctx, string(RegPairingID), pairingID, opts...)
+}
+
+func (d *Device) GetBeaconResponse(opts ...Option) (enabled bool, err error) {
+	return d.GetBeaconResponseContext(context.Background(), opts...)
+}
+
+// GetBeaconResponseContext はビーコン応答フラグ（S15）を取得する
+func (d *Device) GetBeaconResponseContext(ctx context.Context, opts ...Option) (enabled bool, err error) {
+	return d.getRegisterBool(ctx, RegBeaconResponse, opts...)
+}
+
+func (d *Device) SetBeaconResponse(enabled bool, opts ...Option) error {
+	return d.SetBeaconResponseContext(context.Background(), enabled, opts...)
+}
+
+// SetBeaconResponseContext はビーコン応答フラグ（S15）を設定する
+func (d *Device) SetBeaconResponseContext(ctx context.Context, enabled bool, opts ...Option) error {
+	return d.setRegisterBool(ctx, RegBeaconResponse, enabled, opts...)
+}
+
+func (d *Device) GetSessionLifetime(opts ...Option) (lifetime time.Duration, err error) {
+	return d.GetSessionLifetimeContext(context.Background(), opts...)
+}
+
+// GetSessionLifetimeContext はPANAセッションのライフタイム（S16）を取得する
+func (d *Device) GetSessionLifetimeContext(ctx context.Context, opts ...Option) (lifetime time.Duration, err error) {
+	v, err := d.getRegisterUint(ctx, RegSessionLifetime, 32, opts...)
+	return time.Duration(v) * time.Second, err
+}
+
+func (d *Device) SetSessionLifetime(lifetime time.Duration, opts ...Option) error {
+	return d.SetSessionLifetimeContext(context.Background(), lifetime, opts...)
+}
+
+// SetSessionLifetimeContext はPANAセッションのライフタイム（S16）を秒単位で設定する
+func (d *Device) SetSessionLifetimeContext(ctx context.Context, lifetime time.Duration, opts ...Option) error {
+	sec := lifetime / time.Second
+	if lifetime < MinSessionLifetime || sec > 0xFFFFFFFF {
+		return fmt.Errorf("Invalid session lifetime: %v", lifetime)
+	}
+	return d.SetRegisterValueContext(ctx, string(RegSessionLifetime), fmt.Sprintf("%X", int64(sec)), opts...)
+}
+
+func (d *Device) GetAutoReauth(opts ...Option) (enabled bool, err error) {
+	return d.GetAutoReauthContext(context.Background(), opts...)
+}
+
+// GetAutoReauthContext は自動再認証フラグ（S17）を取得する
+func (d *Device) GetAutoReauthContext(ctx context.Context, opts ...Option) (enabled bool, err error) {
+	return d.getRegisterBool(ctx, RegAutoReauth, opts...)
+}
+
+func (d *Device) SetAutoReauth(enabled bool, opts ...Option) error {
+	return d.SetAutoReauthContext(context.Background(), enabled, opts...)
+}
+
+// SetAutoReauthContext は自動再認証フラグ（S17）を設定する
+func (d *Device) SetAutoReauthContext(ctx context.Context, enabled bool, opts ...Option) error {
+	return d.setRegisterBool(ctx, RegAutoReauth, enabled, opts...)
+}
+
+func (d *Device) GetEncryption(opts ...Option) (enabled bool, err error) {
+	return d.GetEncryptionContext(context.Background(), opts...)
+}
+
+// GetEncryptionContext はMAC層の暗号化フラグ（SA0）を取得する
+func (d *Device) GetEncryptionContext(ctx context.Context, opts ...Option) (enabled bool, err error) {
+	return d.getRegisterBool(ctx, RegEncryption, opts...)
+}
+
+func (d *Device) SetEncryption(enabled bool, opts ...Option) error {
+	return d.SetEncryptionContext(context.Background(), enabled, opts...)
+}
+
+// SetEncryptionContext はMAC層の暗号化フラグ（SA0）を設定する
+// スマートメーターとの通信は暗号化が前提なので、通常は変更しないこと
+func (d *Device) SetEncryptionContext(ctx context.Context, enabled bool, opts ...Option) error {
+	return d.setRegisterBool(ctx, RegEncryption, enabled, opts...)
+}
+
+func (d *Device) GetICMPNotify(opts ...Option) (enabled bool, err error) {
+	return d.GetICMPNotifyContext(context.Background(), opts...)
+}
+
+// GetICMPNotifyContext はICMPメッセージの通知フラグ（SA1）を取得する
+func (d *Device) GetICMPNotifyContext(ctx context.Context, opts ...Option) (enabled bool, err error) {
+	return d.getRegisterBool(ctx, RegICMPNotify, opts...)
+}
+
+func (d *Device) SetICMPNotify(enabled bool, opts ...Option) error {
+	return d.SetICMPNotifyContext(context.Background(), enabled, opts...)
+}
+
+// SetICMPNotifyContext はICMPメッセージの通知フラグ（SA1）を設定する
+func (d *Device) SetICMPNotifyContext(ctx context.Context, enabled bool, opts ...Option) error {
+	return d.setRegisterBool(ctx, RegICMPNotify, enabled, opts...)
+}
+
+func (d *Device) GetTransmitTime(opts ...Option) (total time.Duration, err error) {
+	return d.GetTransmitTimeContext(context.Background(), opts...)
+}
+
+// GetTransmitTimeContext は無線送信の積算時間（SFD）を取得する
+func (d *Device) GetTransmitTimeContext(ctx context.Context, opts ...Option) (total time.Duration, err error) {
+	v, err := d.getRegisterUint(ctx, RegTransmitTime, 32, opts...)
+	return time.Duration(v) * time.Millisecond, err
+}
+
+func (d *Device) GetEchoBack(opts ...Option) (enabled bool, err error) {
+	return d.GetEchoBackContext(context.Background(), opts...)
+}
+
+// GetEchoBackContext はエコーバックフラグ（SFE）を取得する
+func (d *Device) GetEchoBackContext(ctx context.Context, opts ...Option) (enabled bool, err error) {
+	return d.getRegisterBool(ctx, RegEchoBack, opts...)
+}
+
+func (d *Device) SetEchoBack(enabled bool, opts ...Option) error {
+	return d.SetEchoBackContext(context.Background(), enabled, opts...)
+}
+
+// SetEchoBackContext はエコーバックフラグ（SFE）を設定する
+func (d *Device) SetEchoBackContext(ctx context.Context, enabled bool, opts ...Option) error {
+	return d.setRegisterBool(ctx, RegEchoBack, enabled, opts...)
+}
+
+func (d *Device) DumpRegisters(opts ...Option) (regs *Registers, err error) {
+	return d.DumpRegistersContext(context.Background(), opts...)
+}
+
+// DumpRegistersContext はKnownRegistersの全ての値を読み出す
+func (d *Device) DumpRegistersContext(ctx context.Context, opts ...Option) (regs *Registers, err error) {
+	r := &Registers{}
+	for _, reg := range KnownRegisters {
+		if err = d.readRegister(ctx, reg, r, opts...); err != nil {
+			return
+		}
+	}
+	return r, nil
+}
+
+// readRegister はレジスタを1つ読み出し、Registersの対応するフィールドに格納する
+func (d *Device) readRegister(ctx context.Context, reg Register, r *Registers, opts ...Option) (err error) {
+	switch reg {
+	case RegChannel:
+		r.Channel, err = d.GetChannelContext(ctx, opts...)
+	case RegPANID:
+		r.PANID, err = d.GetPANIDContext(ctx, opts...)
+	case RegFrameCounter:
+		r.FrameCounter, err = d.GetFrameCounterContext(ctx, opts...)
+	case RegPairingID:
+		r.PairingID, err = d.GetPairingIDContext(ctx, opts...)
+	case RegSessionLifetime:
+		r.SessionLifetime, err = d.GetSessionLifetimeContext(ctx, opts...)
+	case RegTransmitTime:
+		r.TransmitTime, err = d.GetTransmitTimeContext(ctx, opts...)
+	case RegBeaconResponse:
+		r.BeaconResponse, err = d.getRegisterBool(ctx, reg, opts...)
+	case RegAutoReauth:
+		r.AutoReauth, err = d.getRegisterBool(ctx, reg, opts...)
+	case RegEncryption:
+		r.Encryption, err = d.getRegisterBool(ctx, reg, opts...)
+	case RegICMPNotify:
+		r.ICMPNotify, err = d.getRegisterBool(ctx, reg, opts...)
+	case RegTransmitLimited:
+		r.TransmitLimited, err = d.getRegisterBool(ctx, reg, opts...)
+	case RegEchoBack:
+		r.EchoBack, err = d.getRegisterBool(ctx, reg, opts...)
+	case RegAutoLoad:
+		r.AutoLoad, err = d.getRegisterBool(ctx, reg, opts...)
+	default:
+		err = fmt.Errorf("Unknown register: %s", reg)
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package smartmeter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestTypedRegisters(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	if err := dev.SetChannel(0x3B); err != nil {
+		t.Fatalf("SetChannel() error: %v", err)
+	}
+	if err := dev.SetPANID(0x1234); err != nil {
+		t.Fatalf("SetPANID() error: %v", err)
+	}
+	if err := dev.SetPairingID("C0FFEE00"); err != nil {
+		t.Fatalf("SetPairingID() error: %v", err)
+	}
+	if err := dev.SetSessionLifetime(2 * time.Hour); err != nil {
+		t.Fatalf("SetSessionLifetime() error: %v", err)
+	}
+	if err := dev.SetAutoReauth(true); err != nil {
+		t.Fatalf("SetAutoReauth() error: %v", err)
+	}
+	if err := dev.SetICMPNotify(true); err != nil {
+		t.Fatalf("SetICMPNotify() error: %v", err)
+	}
+	if err := dev.SetEncryption(false); err != nil {
+		t.Fatalf("SetEncryption() error: %v", err)
+	}
+	if v, err := dev.GetEncryption(); err != nil || v {
+		t.Errorf("GetEncryption() differ: %v, %v", v, err)
+	}
+	if v := m.Register("S16"); v != "1C20" {
+		t.Errorf("S16 differ: %q != %q", v, "1C20")
+	}
+
+	regs, err := dev.DumpRegisters()
+	if err != nil {
+		t.Fatalf("DumpRegisters() error: %v", err)
+	}
+	if regs.Channel != 0x3B || regs.PANID != 0x1234 || regs.PairingID != "C0FFEE00" {
+		t.Errorf("Unexpected registers: %+v", regs)
+	}
+	if regs.SessionLifetime != 2*time.Hour || !regs.AutoReauth || !regs.BeaconResponse || regs.EchoBack {
+		t.Errorf("Unexpected registers: %+v", regs)
+	}
+	if !regs.ICMPNotify || regs.Encryption {
+		t.Errorf("Unexpected registers: %+v", regs)
+	}
+}
+
+func TestTypedRegistersValidation(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	// Open時にSFBを読むので、それ以降のSKSREGを数える
+	opened := countCommand(m, "SKSREG")
+
+	if err := dev.SetChannel(0x20); err == nil {
+		t.Errorf("SetChannel() should reject channel 0x20")
+	}
+	if err := dev.SetPairingID("C0FFEE"); err == nil {
+		t.Errorf("SetPairingID() should reject short ID")
+	}
+	if err := dev.SetSessionLifetime(59 * time.Second); err == nil {
+		t.Errorf("SetSessionLifetime() should reject lifetime under 60sec")
+	}
+	if cmds := countCommand(m, "SKSREG") - opened; cmds != 0 {
+		t.Errorf("Invalid values should not be sent: %d commands", cmds)
+	}
+}
@@ -0,0 +1,174 @@
+package smartmeter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScanProgress はスキャンの進捗を表す構造体
+// Beaconを受信したとき（EVENT 20）と、チャンネルマスク全体のスキャンが1回終わったとき（EVENT 22）に通知される
+type ScanProgress struct {
+	Event    Event           // EVENT 20（Beacon受信）またはEVENT 22（スキャン完了）
+	Pass     int             // 何回目のスキャンか（1から数える）
+	Duration int             // このスキャンのスキャン時間の指定値
+	Mask     uint32          // このスキャンのチャンネルマスク
+	PANs     []PANDescriptor // このスキャンで見つかったPAN（EVENT 22のときのみ）
+}
+
+// defaultScanDurations はScanDurations()を指定しなかったときのスキャン時間
+// 近くのスマートメーターは短いスキャンで見つかるので、短い時間から始めて延ばしていく
+var defaultScanDurations = []int{4, 6, 8}
+
+// scanMask はスキャン対象のチャンネルマスクを返す
+// ScanChannelMask()の指定、Channelの指定、全チャンネルの順に優先する
+func (d *Device) scanMask() (mask uint32, err error) {
+	if d.scanChannelMask != 0 {
+		return d.scanChannelMask, nil
+	}
+	mask = 0xffffffff
+	if channel := d.SessionInfo().Channel; channel != "" {
+		var i int64
+		i, err = strconv.ParseInt(channel, 16, 0)
+		if err != nil {
+			err = fmt.Errorf(`Specified channel is invalid: "%s"`, channel)
+			return
+		} else if i < 33 || i > 60 {
+			err = fmt.Errorf(`Channel must be 21-3C: "%s"`, channel)
+			return
+		}
+		mask = 1 << (i - 33)
+	}
+	return
+}
+
+// scanTimeout はスキャン時間の指定値から1回のスキャンにかかる時間の目安を返す
+// 1チャンネルあたり約9.6ms * (2^duration + 1)かかるので、1割と5秒の余裕を持たせる
+func scanTimeout(mask uint32, duration int) time.Duration {
+	channels := 0
+	for m := mask; m != 0; m >>= 1 {
+		channels += int(m & 1)
+	}
+	perChannel := 9600 * time.Microsecond * time.Duration((1<<uint(duration))+1)
+	estimate := time.Duration(channels) * perChannel
+	return estimate + estimate/10 + 5*time.Second
+}
+
+// scanTimeoutOption はSKSCANのタイムアウトとして、スキャン時間からの見積もりとDeviceに指定したTimeout()の長い方を返す
+// Scan()などの呼び出しで指定したTimeout()はこれより優先する
+func (d *Device) scanTimeoutOption(mask uint32, duration int) Option {
+	timeout := scanTimeout(mask, duration)
+	if q, err := NewSKQuery(d, "", d.options...); err == nil && q.timeout > timeout {
+		timeout = q.timeout
+	}
+	return Timeout(timeout)
+}
+
+// activeScan はSKSCANでアクティブスキャンを1回行い、見つかったPANを返す
+func (d *Device) activeScan(ctx context.Context, mask uint32, duration int, pass int, opts ...Option) (pans []PANDescriptor, err error) {
+	if duration < 0 || duration > 14 {
+		err = fmt.Errorf("Scan duration must be 0-14: %d", duration)
+		return
+	}
+	profile := d.Profile()
+	cmd := profile.ScanCommand(2, mask, duration)
+
+	progress := func(ev Event, pans []PANDescriptor) {
+		if d.scanProgress != nil {
+			d.scanProgress(ScanProgress{Event: ev, Pass: pass, Duration: duration, Mask: mask, PANs: pans})
+		}
+	}
+	var done Event
+	callback := func(line string) (bool, error) {
+		if ev, ok := d.lineEvent(line); ok {
+			switch ev.Code {
+			case EventBeaconReceived:
+				progress(ev, nil)
+			case EventActiveScanDone:
+				done = ev
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	overrides := []Option{d.scanTimeoutOption(mask, duration)}
+	skscanOpts := append([]Option{Reader(callback)}, opts...)
+	res, err := d.querySKCommandContext(ctx, cmd, overrides, skscanOpts...)
+	if d.fallbackProfile(profile, err) {
+		cmd = d.Profile().ScanCommand(2, mask, duration)
+		res, err = d.querySKCommandContext(ctx, cmd, overrides, skscanOpts...)
+	}
+	if err != nil {
+		return
+	}
+	pans = d.parsePANDescriptors(res)
+	d.infof("Scan pass %d (duration %d): %d PAN(s) found", pass, duration, len(pans))
+	progress(done, pans)
+	return
+}
+
+func (d *Device) EnergyScan(mask uint32, duration int, opts ...Option) (rssi map[int]float64, err error) {
+	return d.EnergyScanContext(context.Background(), mask, duration, opts...)
+}
+
+// EnergyScanContext はEDスキャン（SKSCAN 0）を行い、チャンネルごとの受信信号強度[dBm]を返す
+// チャンネルの混雑状況や干渉の調査に使う。maskのbit0がチャンネル0x21に対応する
+func (d *Device) EnergyScanContext(ctx context.Context, mask uint32, duration int, opts ...Option) (rssi map[int]float64, err error) {
+	if mask == 0 {
+		err = errors.New("Channel mask is empty")
+		return
+	}
+	if duration < 0 || duration > 14 {
+		err = fmt.Errorf("Scan duration must be 0-14: %d", duration)
+		return
+	}
+	profile := d.Profile()
+	cmd := profile.ScanCommand(0, mask, duration)
+
+	callback := func(line string) (bool, error) {
+		if ev, ok := d.lineEvent(line); ok && ev.Code == EventEDScanDone {
+			return true, nil
+		}
+		return false, nil
+	}
+	overrides := []Option{d.scanTimeoutOption(mask, duration)}
+	edscanOpts := append([]Option{Reader(callback)}, opts...)
+	res, err := d.querySKCommandContext(ctx, cmd, overrides, edscanOpts...)
+	if d.fallbackProfile(profile, err) {
+		cmd = d.Profile().ScanCommand(0, mask, duration)
+		res, err = d.querySKCommandContext(ctx, cmd, overrides, edscanOpts...)
+	}
+	if err != nil {
+		return
+	}
+	return parseEDScan(res)
+}
+
+// parseEDScan はEEDSCANの後に続く「<CHANNEL> <RSSI> <CHANNEL> <RSSI> ...」の行を解析する
+func parseEDScan(res string) (rssi map[int]float64, err error) {
+	lines := strings.Split(res, "\n")
+	for i, line := range lines {
+		if line != "EEDSCAN" || i+1 >= len(lines) {
+			continue
+		}
+		fields := strings.Fields(lines[i+1])
+		if len(fields)%2 != 0 {
+			break
+		}
+		rssi = map[int]float64{}
+		for j := 0; j < len(fields); j += 2 {
+			ch, err1 := strconv.ParseUint(fields[j], 16, 8)
+			v, err2 := strconv.ParseUint(fields[j+1], 16, 8)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("EEDSCAN parse error (not a hexadecimal): %s", lines[i+1])
+			}
+			rssi[int(ch)] = lqiToRSSI(int(v))
+		}
+		return
+	}
+	err = fmt.Errorf(`Unexpected response for SKSCAN 0: "%s"`, res)
+	return
+}
@@ -0,0 +1,184 @@
+package smartmeter_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestScanEscalation(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	m.Meter.MinScanDuration = 6
+	defer m.Close()
+
+	var progress []smartmeter.ScanProgress
+	dev := newTestDevice(t, m,
+		smartmeter.ScanDurations(4, 6, 8),
+		smartmeter.ScanProgressFunc(func(p smartmeter.ScanProgress) {
+			progress = append(progress, p)
+		}))
+	pans, err := dev.Scan()
+	if err != nil {
+		t.Fatalf("Scan() error: %v", err)
+	}
+	if len(pans) != 1 || dev.Channel != "33" {
+		t.Errorf("Unexpected scan result: %+v, channel=%s", pans, dev.Channel)
+	}
+	if n := countCommand(m, "SKSCAN"); n != 2 {
+		t.Errorf("SKSCAN count differ: %d != 2", n)
+	}
+
+	expected := []struct {
+		code     smartmeter.EventCode
+		pass     int
+		duration int
+		pans     int
+	}{
+		{smartmeter.EventActiveScanDone, 1, 4, 0},
+		{smartmeter.EventBeaconReceived, 2, 6, 0},
+		{smartmeter.EventActiveScanDone, 2, 6, 1},
+	}
+	if len(progress) != len(expected) {
+		t.Fatalf("Number of progress callbacks differ: %d != %d", len(progress), len(expected))
+	}
+	for i, e := range expected {
+		p := progress[i]
+		if p.Event.Code != e.code || p.Pass != e.pass || p.Duration != e.duration || len(p.PANs) != e.pans {
+			t.Errorf("Unexpected progress #%d: %+v", i, p)
+		}
+	}
+}
+
+func TestScanEscalationAfterTimeout(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	// 1回目のSKSCANはEVENT 22を返さずにタイムアウトさせる
+	m.Inject(sktest.Fault{Command: "SKSCAN", Lines: []string{"OK"}})
+
+	dev := newTestDevice(t, m, smartmeter.ScanDurations(4, 6))
+	pans, err := dev.Scan(smartmeter.Timeout(200 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("Scan() error: %v", err)
+	}
+	if len(pans) != 1 {
+		t.Errorf("Number of PANs differ: %d != 1", len(pans))
+	}
+	if n := countCommand(m, "SKSCAN"); n != 2 {
+		t.Errorf("SKSCAN count differ: %d != 2", n)
+	}
+}
+
+func TestScanDefaultDurations(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	m.Meter.MinScanDuration = 6
+	defer m.Close()
+
+	// ScanDurations()を指定しなくても短いスキャン時間から延ばしていく
+	var durations []int
+	dev := newTestDevice(t, m, smartmeter.ScanProgressFunc(func(p smartmeter.ScanProgress) {
+		if p.Event.Code == smartmeter.EventActiveScanDone {
+			durations = append(durations, p.Duration)
+		}
+	}))
+	if _, err := dev.Scan(); err != nil {
+		t.Fatalf("Scan() error: %v", err)
+	}
+	if !reflect.DeepEqual(durations, []int{4, 6}) {
+		t.Errorf("Scan durations differ: %v != [4 6]", durations)
+	}
+}
+
+func TestScanDeviceTimeout(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	// EVENT 22がDeviceのTimeout()より遅れて届く
+	m.Inject(sktest.Fault{Command: "SKSCAN", Lines: []string{"OK"}})
+	time.AfterFunc(300*time.Millisecond, func() { m.Emit("EVENT 22 " + m.IPAddr()) })
+
+	var done int
+	dev := newTestDevice(t, m,
+		smartmeter.Timeout(100*time.Millisecond),
+		smartmeter.ScanDurations(4),
+		smartmeter.ScanProgressFunc(func(p smartmeter.ScanProgress) {
+			if p.Event.Code == smartmeter.EventActiveScanDone {
+				done++
+			}
+		}))
+	// Deviceに指定したTimeout()が見積もりより短ければ、見積もりを使う
+	if _, err := dev.Scan(); !errors.Is(err, smartmeter.ErrPANNotFound) {
+		t.Errorf("Scan() should return ErrPANNotFound: %v", err)
+	}
+	if done != 1 {
+		t.Errorf("Scan pass should complete without timeout: %d", done)
+	}
+}
+
+func TestScanTimeoutReported(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	m.Inject(sktest.Fault{Command: "SKSCAN", Lines: []string{"OK"}})
+
+	dev := newTestDevice(t, m, smartmeter.ScanDurations(4))
+	_, err := dev.Scan(smartmeter.Timeout(100 * time.Millisecond))
+	if !errors.Is(err, smartmeter.ErrPANNotFound) {
+		t.Fatalf("Scan() should return ErrPANNotFound: %v", err)
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Scan() error should mention the timeout: %v", err)
+	}
+}
+
+func TestScanBudget(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	m.Meter.MinScanDuration = 8
+	defer m.Close()
+
+	dev := newTestDevice(t, m,
+		smartmeter.ScanDurations(2, 3),
+		smartmeter.ScanChannelMask(1<<(0x33-0x21)),
+		smartmeter.ScanBudget(200*time.Millisecond))
+	_, err := dev.Scan()
+	if !errors.Is(err, smartmeter.ErrPANNotFound) {
+		t.Errorf("Scan() should return ErrPANNotFound: %v", err)
+	}
+	if n := countCommand(m, "SKSCAN"); n < 3 {
+		t.Errorf("Scan() should repeat the last duration within the budget: %d", n)
+	}
+}
+
+func TestEnergyScan(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	m.EDValues = map[int]int{0x21: 0x80}
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	rssi, err := dev.EnergyScan(0x0FFFFFFF, 4)
+	if err != nil {
+		t.Fatalf("EnergyScan() error: %v", err)
+	}
+	if len(rssi) != 28 {
+		t.Errorf("Number of channels differ: %d != 28", len(rssi))
+	}
+	if v := rssi[0x21]; v < -69.1 || v > -69.0 {
+		t.Errorf("RSSI of channel 0x21 differ: %f", v)
+	}
+	if rssi[0x21] <= rssi[0x22] {
+		t.Errorf("Channel 0x21 should be noisier than 0x22: %f, %f", rssi[0x21], rssi[0x22])
+	}
+
+	if _, err := dev.EnergyScan(0, 4); err == nil {
+		t.Errorf("EnergyScan() should fail with empty mask")
+	}
+}
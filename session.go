@@ -0,0 +1,209 @@
+package smartmeter
+
+import (
+	"context"
+	"errors"
+)
+
+// SessionState はBルートのPANAセッションの状態
+type SessionState int
+
+const (
+	SessionNone       SessionState = iota // このDeviceでは未接続
+	SessionJoined                         // 接続済み（EVENT 25）
+	SessionExpired                        // ライフタイム経過で期限切れ（EVENT 29）
+	SessionTerminated                     // 切断済み（EVENT 26/27/28）
+	SessionFailed                         // 接続失敗（EVENT 24）
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionJoined:
+		return "joined"
+	case SessionExpired:
+		return "expired"
+	case SessionTerminated:
+		return "terminated"
+	case SessionFailed:
+		return "failed"
+	}
+	return "none"
+}
+
+// ReauthPolicy はPANAセッションが切れていた場合の自動再接続の方針
+type ReauthPolicy int
+
+const (
+	ReauthNone         ReauthPolicy = iota // 自動再接続しない（デフォルト）
+	ReauthJoin                             // Rejoin()、だめならJoin()で再接続する
+	ReauthAuthenticate                     // ReauthJoinと同様に再接続し、失敗したらAuthenticate()でスキャンからやり直す
+)
+
+// ErrNotJoined はPANAセッションが確立されていないため送信できなかったときに返る
+var ErrNotJoined = errors.New("PANA session is not established")
+
+// SessionState は現在のPANAセッションの状態を返す
+func (d *Device) SessionState() SessionState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.session
+}
+
+// updateSession はEVENTに応じてPANAセッションの状態を更新する
+func (d *Device) updateSession(ev Event) {
+	if ev.Side != 0 {
+		// HAN側のイベントはBルートのセッションと無関係
+		return
+	}
+	var state SessionState
+	switch ev.Code {
+	case EventPANAConnected:
+		state = SessionJoined
+	case EventPANAFailed:
+		state = SessionFailed
+	case EventSessionExpired:
+		state = SessionExpired
+	case EventSessionTerminationRequested, EventSessionTerminated, EventSessionTerminationTimeout:
+		state = SessionTerminated
+	default:
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if state == SessionJoined {
+		d.joins++
+	}
+	if d.session != state {
+		d.infof("PANA session state: %s -> %s (%s)", d.session, state, ev)
+	}
+	d.session = state
+}
+
+// sessionLost は再接続してからリトライすべき状態か判定する
+func (d *Device) sessionLost(err error) bool {
+	if d.reauthPolicy == ReauthNone {
+		return false
+	}
+	if errors.Is(err, ErrNotJoined) || errors.Is(err, ErrTimeout) {
+		return true
+	}
+	switch d.SessionState() {
+	case SessionExpired, SessionTerminated, SessionFailed:
+		return true
+	}
+	return d.SessionInfo().IPAddr == "" && d.reauthPolicy == ReauthAuthenticate
+}
+
+// reauthenticate はReauthPolicyに従ってPANAセッションを張り直す
+// joinsはクエリ開始時点のjoinCount()で、複数のクエリが同時にセッション切れを検出しても再接続は1回だけ行う
+func (d *Device) reauthenticate(ctx context.Context, joins int, opts ...Option) (err error) {
+	d.reauthMu.Lock()
+	defer d.reauthMu.Unlock()
+
+	if d.joinCount() != joins && d.SessionState() == SessionJoined {
+		// 待っている間に他のクエリが再接続した
+		return nil
+	}
+	d.warnf("Re-authenticating PANA session (state: %s)", d.SessionState())
+	if d.SessionInfo().IPAddr != "" {
+		if d.Profile().Supports(FeatureRejoin) {
+			if err = d.RejoinContext(ctx, opts...); err == nil || ctx.Err() != nil {
+				return
+			}
+			d.warnf("Rejoin failed, joining again: %+v", err)
+		}
+		err = d.JoinContext(ctx, opts...)
+	} else {
+		err = errors.New("IP address for smart electric energy meter is not specifed")
+	}
+	if err != nil && d.reauthPolicy == ReauthAuthenticate {
+		err = d.AuthenticateContext(ctx, opts...)
+	}
+	return
+}
+
+// joinCount はこれまでにPANA接続が完了した回数を返す
+func (d *Device) joinCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.joins
+}
+
+func (d *Device) Terminate(opts ...Option) (err error) {
+	return d.TerminateContext(context.Background(), opts...)
+}
+
+// TerminateContext はPANAセッションを終了する（SKTERM）
+// EVENT 27（終了成功）かEVENT 28（応答なしでタイムアウト）を待つ。どちらの場合もモジュール側のセッションは破棄される
+// モジュールにセッションがなければ何もしない
+func (d *Device) TerminateContext(ctx context.Context, opts ...Option) (err error) {
+	callback := func(line string) (bool, error) {
+		if ev, ok := d.lineEvent(line); ok && ev.Side == 0 {
+			switch ev.Code {
+			case EventSessionTerminated:
+				return true, nil
+			case EventSessionTerminationTimeout:
+				d.warnf("No response for PANA session termination: %s", line)
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	termOpts := append([]Option{Reader(callback)}, opts...)
+	_, err = d.QuerySKCommandContext(ctx, "SKTERM", termOpts...)
+	var skErr *SKError
+	if errors.As(err, &skErr) && skErr.Code == ErrCodeExecFailed {
+		// 終了すべきセッションがない
+		err = nil
+	}
+	return
+}
+
+func (d *Device) Reset(opts ...Option) (err error) {
+	return d.ResetContext(context.Background(), opts...)
+}
+
+// ResetContext はSKSTACK-IPのプロトコルスタックを初期化し（SKRESET）、IDやパスワードなどの設定を再度書き込む
+// PANAセッションも失われるので、AutoReauth()を指定していれば次のQueryEchonetLite()で再接続する
+func (d *Device) ResetContext(ctx context.Context, opts ...Option) (err error) {
+	if _, err = d.QuerySKCommandContext(ctx, "SKRESET", opts...); err != nil {
+		return
+	}
+	d.mu.Lock()
+	if d.session == SessionJoined {
+		d.session = SessionTerminated
+	}
+	d.mu.Unlock()
+
+	if d.ID != "" {
+		if err = d.SetIDContext(ctx, opts...); err != nil {
+			return
+		}
+	}
+	if d.Password != "" {
+		if err = d.SetPasswordContext(ctx, opts...); err != nil {
+			return
+		}
+	}
+	if target := d.SessionInfo(); target.Channel != "" && target.PanID != "" {
+		if err = d.SetRegisterValueContext(ctx, string(RegChannel), target.Channel, opts...); err != nil {
+			return
+		}
+		err = d.SetRegisterValueContext(ctx, string(RegPANID), target.PanID, opts...)
+	}
+	return
+}
+
+func (d *Device) Shutdown(opts ...Option) (err error) {
+	return d.ShutdownContext(context.Background(), opts...)
+}
+
+// ShutdownContext はPANAセッションを終了してからシリアルポートを閉じる
+// 次に起動したプロセスが中途半端に接続されたモジュールを掴まないよう、Close()の代わりに使う
+func (d *Device) ShutdownContext(ctx context.Context, opts ...Option) (err error) {
+	err = d.TerminateContext(ctx, opts...)
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return
+}
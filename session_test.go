@@ -0,0 +1,294 @@
+package smartmeter_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func waitSessionState(t *testing.T, dev *smartmeter.Device, state smartmeter.SessionState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for dev.SessionState() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("Session state differ: %s != %s", dev.SessionState(), state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func countCommand(m *sktest.Module, name string) (n int) {
+	for _, cmd := range m.Commands() {
+		if cmd == name {
+			n++
+		}
+	}
+	return
+}
+
+func TestSessionState(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	if s := dev.SessionState(); s != smartmeter.SessionNone {
+		t.Errorf("Initial session state differ: %s", s)
+	}
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	waitSessionState(t, dev, smartmeter.SessionJoined)
+
+	m.ExpireSession()
+	waitSessionState(t, dev, smartmeter.SessionExpired)
+
+	m.Emit("EVENT 26 " + m.Meter.IPAddr())
+	waitSessionState(t, dev, smartmeter.SessionTerminated)
+}
+
+func TestAutoReauthAfterExpiration(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.AutoReauth(smartmeter.ReauthJoin))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.ExpireSession()
+	waitSessionState(t, dev, smartmeter.SessionExpired)
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Fatalf("QueryEchonetLite() error: %v", err)
+	}
+	if n := countCommand(m, "SKREJOIN"); n != 1 {
+		t.Errorf("SKREJOIN count differ: %d != 1", n)
+	}
+	if n := countCommand(m, "SKJOIN"); n != 1 {
+		t.Errorf("SKJOIN count differ: %d != 1", n)
+	}
+	if n := countCommand(m, "SKSCAN"); n != 1 {
+		t.Errorf("SKSCAN count differ: %d != 1", n)
+	}
+}
+
+func TestAutoReauthFallbackToJoin(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.AutoReauth(smartmeter.ReauthJoin))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	// SKTERMの後はSKREJOINがER10になるので、SKJOINでやり直す
+	if err := dev.Terminate(); err != nil {
+		t.Fatalf("Terminate() error: %v", err)
+	}
+	waitSessionState(t, dev, smartmeter.SessionTerminated)
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Fatalf("QueryEchonetLite() error: %v", err)
+	}
+	if n := countCommand(m, "SKREJOIN"); n != 1 {
+		t.Errorf("SKREJOIN count differ: %d != 1", n)
+	}
+	if n := countCommand(m, "SKJOIN"); n != 2 {
+		t.Errorf("SKJOIN count differ: %d != 2", n)
+	}
+}
+
+func TestAutoReauthOnUnconnected(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	fault := sktest.Fault{
+		Command: "SKSENDTO",
+		Lines:   []string{"EVENT 21 " + m.Meter.IPAddr() + " 02", "OK"},
+	}
+	m.Inject(fault)
+	_, err := dev.QueryEchonetLite(newInstantaneousPowerRequest())
+	if !errors.Is(err, smartmeter.ErrNotJoined) {
+		t.Errorf("QueryEchonetLite() should return ErrNotJoined without AutoReauth: %v", err)
+	}
+
+}
+
+func TestAutoReauthOnUnconnectedWithPolicy(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.AutoReauth(smartmeter.ReauthJoin))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	m.Inject(sktest.Fault{
+		Command: "SKSENDTO",
+		Lines:   []string{"EVENT 21 " + m.Meter.IPAddr() + " 02", "OK"},
+	})
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Errorf("QueryEchonetLite() should succeed after re-authentication: %v", err)
+	}
+	if n := countCommand(m, "SKREJOIN"); n != 1 {
+		t.Errorf("SKREJOIN count differ: %d != 1", n)
+	}
+}
+
+func TestAutoReauthFallbackToAuthenticate(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.AutoReauth(smartmeter.ReauthAuthenticate))
+
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Fatalf("QueryEchonetLite() should authenticate on demand: %v", err)
+	}
+	if !m.Joined() {
+		t.Errorf("Module should be joined")
+	}
+}
+
+func TestConcurrentQueriesDuringReauth(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.AutoReauth(smartmeter.ReauthAuthenticate))
+
+	// 1つ目のクエリがスキャンで接続先を書き換えている間に、他のクエリが接続先を読む
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dev.QueryEchonetLite(newInstantaneousPowerRequest())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("QueryEchonetLite() error: %v", err)
+		}
+	}
+	if n := countCommand(m, "SKSCAN"); n != 1 {
+		t.Errorf("SKSCAN count differ: %d != 1", n)
+	}
+	if info := dev.SessionInfo(); info.IPAddr != m.Meter.IPAddr() {
+		t.Errorf("IPAddr differ: %q != %q", info.IPAddr, m.Meter.IPAddr())
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	if err := dev.Terminate(); err != nil {
+		t.Fatalf("Terminate() error: %v", err)
+	}
+	if m.Joined() {
+		t.Errorf("Module should not be joined after Terminate()")
+	}
+	waitSessionState(t, dev, smartmeter.SessionTerminated)
+
+	// セッションがなければ何もしない
+	if err := dev.Terminate(); err != nil {
+		t.Errorf("Terminate() without session error: %v", err)
+	}
+
+	// 相手から応答がなくてもEVENT 28で完了する
+	m.Inject(sktest.Fault{Command: "SKTERM", Lines: []string{"OK", "EVENT 28 " + m.Meter.IPAddr()}})
+	if err := dev.Terminate(); err != nil {
+		t.Errorf("Terminate() with EVENT 28 error: %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m, smartmeter.AutoReauth(smartmeter.ReauthJoin))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	if err := dev.Reset(); err != nil {
+		t.Fatalf("Reset() error: %v", err)
+	}
+	if m.Joined() {
+		t.Errorf("Module should not be joined after Reset()")
+	}
+	if s := dev.SessionState(); s != smartmeter.SessionTerminated {
+		t.Errorf("Session state differ: %s != %s", s, smartmeter.SessionTerminated)
+	}
+	if m.Register("S02") != "33" || m.Register("S03") != "8888" {
+		t.Errorf("Channel and PAN ID should be re-applied: %s %s", m.Register("S02"), m.Register("S03"))
+	}
+
+	// IDとパスワードが再設定されているので、スキャンせずにJoinで復帰できる
+	if _, err := dev.QueryEchonetLite(newInstantaneousPowerRequest()); err != nil {
+		t.Fatalf("QueryEchonetLite() error: %v", err)
+	}
+	if n := countCommand(m, "SKJOIN"); n != 2 {
+		t.Errorf("SKJOIN count differ: %d != 2", n)
+	}
+	if n := countCommand(m, "SKSCAN"); n != 1 {
+		t.Errorf("SKSCAN count differ: %d != 1", n)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	if err := dev.Shutdown(); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+	if m.Joined() {
+		t.Errorf("Module should not be joined after Shutdown()")
+	}
+	if _, err := dev.GetVersion(); !errors.Is(err, smartmeter.ErrClosed) {
+		t.Errorf("GetVersion() after Shutdown() should return ErrClosed: %v", err)
+	}
+}
+
+func TestRejoin(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	var skErr *smartmeter.SKError
+	if err := dev.Rejoin(); !errors.As(err, &skErr) || skErr.Code != smartmeter.ErrCodeExecFailed {
+		t.Errorf("Rejoin() before Join() should fail with ER10: %v", err)
+	}
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	m.ExpireSession()
+	waitSessionState(t, dev, smartmeter.SessionExpired)
+	if err := dev.Rejoin(); err != nil {
+		t.Fatalf("Rejoin() error: %v", err)
+	}
+	waitSessionState(t, dev, smartmeter.SessionJoined)
+}
@@ -0,0 +1,823 @@
+// Package sktest はSKSTACK-IPを搭載したWi-SUNモジュール（BP35A1, BP35C0, RL7023など）を
+// 行単位で模倣するシミュレータを提供する。実機なしでsmartmeter.Deviceをテストするために使う。
+//
+//	m := sktest.NewModule()
+//	m.Meter = sktest.NewMeter()
+//	dev, err := smartmeter.NewDevice(m, smartmeter.ID(m.Meter.ID), smartmeter.Password(m.Meter.Password))
+package sktest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+)
+
+// Module はSKSTACK-IPモジュールのシミュレータ
+// io.ReadWriteCloserを実装しているので、そのままsmartmeter.NewDevice()に渡せる
+// 公開フィールドは最初のコマンドを送る前に設定すること
+type Module struct {
+	Version    string      // SKVERの応答
+	AppVersion string      // SKAPPVERの応答。空ならSKAPPVERはFAIL ER04になる
+	DualStack  bool        // デュアルスタックモジュール（BP35C0など）として振る舞う
+	OmitLQI    bool        // デュアルスタックモジュールでERXUDPに<LQI>を付けない（<LQI>を出力しないファームウェアの模倣用）
+	MACAddr    string      // モジュール自身のMACアドレス（16進16桁）
+	Meter      *Meter      // 通信相手のスマートメーター。nilならスキャンで何も見つからない
+	Others     []*Meter    // スキャンでは見えるが接続できない他のスマートメーター（集合住宅の模倣用）
+	EDValues   map[int]int // EDスキャンで返すチャンネルごとのED値。未指定のチャンネルは0x20
+
+	mu       sync.Mutex
+	regs     map[string]string
+	saved    map[string]string // SKSAVEでフラッシュに保存したレジスタ
+	id       string
+	password string
+	joined   bool
+	paa      string // 最後にJoinしたPAAのアドレス。SKREJOINの接続先
+	nbrs     []string
+	udpPorts []int
+	tcpPorts []int // SKTCPPORTで設定したTCPの待ち受けポート
+	tcpConns map[int]*tcpConn
+	ascii    bool // WOPTで設定した表示形式。falseならERXUDPなどのデータ部をバイナリで出力する
+	faults   []*Fault
+	commands []string
+
+	hostR *io.PipeReader // Device側が読む
+	hostW *io.PipeWriter // Device側が書く
+	modR  *io.PipeReader
+	modW  *io.PipeWriter
+	out   chan string
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Meter はシミュレータから見える低圧スマート電力量メータ
+type Meter struct {
+	ID       string // Bルート認証ID
+	Password string // Bルート認証パスワード
+	Channel  int    // 使用チャンネル（0x21〜0x3C）
+	PanID    uint16
+	MACAddr  string // 16進16桁
+	LQI      int
+	PairID   string // 16進8桁。空ならEPANDESCに含めない
+
+	// MinScanDuration はこのメーターを発見できる最小のスキャン時間（電波状況の模倣用）
+	MinScanDuration int
+
+	// Properties はGet要求に対して返すプロパティ値
+	Properties map[smartmeter.PropertyCode][]byte
+	// Handler はECHONET Liteの要求に対する応答を作る。nilならPropertiesから応答を作る
+	Handler func(req *smartmeter.Frame) *smartmeter.Frame
+}
+
+// Fault は次に一致するコマンドに対する応答を差し替える
+type Fault struct {
+	Command string   // 対象のコマンド名（"SKSENDTO"など）
+	Lines   []string // 本来の応答の代わりに出力する行。空なら何も応答しない
+	Times   int      // 適用回数。0なら1回
+}
+
+// NewModule はシミュレータを作成して動作を開始する
+func NewModule() *Module {
+	m := &Module{
+		Version:    "1.2.10",
+		AppVersion: "rev26e",
+		MACAddr:    "001D129012345678",
+		regs:       defaultRegisters(),
+		udpPorts:   []int{3610, 716, 0, 0, 0, 0},
+		tcpPorts:   make([]int, maxTCPHandle),
+		tcpConns:   map[int]*tcpConn{},
+		out:        make(chan string, 256),
+		done:       make(chan struct{}),
+	}
+	m.modR, m.hostW = io.Pipe()
+	m.hostR, m.modW = io.Pipe()
+	go m.writeLoop()
+	go m.readLoop()
+	return m
+}
+
+// defaultRegisters は起動直後の仮想レジスタの値を返す
+func defaultRegisters() map[string]string {
+	return map[string]string{
+		"S02": "21",
+		"S03": "FFFF",
+		"S07": "00000000",
+		"S0A": "00000000",
+		"S15": "1",
+		"S16": "384",
+		"S17": "0",
+		"SA0": "0",
+		"SA1": "0",
+		"SFB": "0",
+		"SFD": "00000000",
+		"SFE": "0",
+		"SFF": "0",
+	}
+}
+
+// NewMeter はテスト用の典型的な設定のスマートメーターを返す
+func NewMeter() *Meter {
+	return &Meter{
+		ID:       "00000000000000000000000000000000",
+		Password: "AB0123456789",
+		Channel:  0x33,
+		PanID:    0x8888,
+		MACAddr:  "001C6400030C12A4",
+		LQI:      0xE1,
+		Properties: map[smartmeter.PropertyCode][]byte{
+			smartmeter.LvSmartElectricEnergyMeter_InstantaneousElectricPower: {0x00, 0x00, 0x01, 0x85},
+			smartmeter.LvSmartElectricEnergyMeter_InstantaneousCurrent:       {0x00, 0x14, 0x00, 0x64},
+		},
+	}
+}
+
+// IPAddr はメーターのリンクローカルアドレスを返す
+func (mt *Meter) IPAddr() string {
+	return LinkLocalAddr(mt.MACAddr)
+}
+
+// LinkLocalAddr はMACアドレスからSKLL64と同じ形式のIPv6リンクローカルアドレスを作る
+func LinkLocalAddr(macAddr string) string {
+	b, err := hex.DecodeString(macAddr)
+	if err != nil || len(b) != 8 {
+		return ""
+	}
+	b[0] ^= 0x02
+	return fmt.Sprintf("FE80:0000:0000:0000:%02X%02X:%02X%02X:%02X%02X:%02X%02X", b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7])
+}
+
+// Read はモジュールからの出力を読む
+func (m *Module) Read(p []byte) (int, error) {
+	return m.hostR.Read(p)
+}
+
+// Write はモジュールへコマンドを書き込む
+func (m *Module) Write(p []byte) (int, error) {
+	return m.hostW.Write(p)
+}
+
+// Close はシミュレータを停止する
+func (m *Module) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		m.hostW.Close()
+		m.hostR.Close()
+	})
+	return nil
+}
+
+// Disconnect はモジュールの出力をEOFで終了させる（USBドングルの抜去の模倣用）
+func (m *Module) Disconnect() {
+	m.modW.Close()
+}
+
+// ExpireSession はPANAセッションを期限切れにしてEVENT 29を出力する
+func (m *Module) ExpireSession() {
+	m.mu.Lock()
+	m.joined = false
+	line := m.event(0x29, m.Meter.IPAddr(), "")
+	m.mu.Unlock()
+	m.println(line)
+}
+
+// LimitTransmission は送信総和時間の制限の発動（EVENT 32）と解除（EVENT 33）を模倣する
+// 制限中はSFBが1になり、SKSENDTOはFAIL ER10になる
+// 起動前から制限中のモジュールを模倣するには、EVENTを出さないSetRegister("SFB", "1")を使う
+func (m *Module) LimitTransmission(limited bool) {
+	code, sfb := 0x33, "0"
+	if limited {
+		code, sfb = 0x32, "1"
+	}
+	m.mu.Lock()
+	m.regs["SFB"] = sfb
+	line := m.event(code, m.IPAddr(), "")
+	m.mu.Unlock()
+	m.println(line)
+}
+
+// Joined はPANAセッションが確立しているか返す
+func (m *Module) Joined() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.joined
+}
+
+// Inject はコマンドに対する応答を差し替える障害を登録する
+func (m *Module) Inject(f Fault) {
+	if f.Times <= 0 {
+		f.Times = 1
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.faults = append(m.faults, &f)
+}
+
+// Emit はコマンドと無関係にモジュールから行を出力する（EVENTやERXUDPの模倣用）
+func (m *Module) Emit(lines ...string) {
+	m.println(lines...)
+}
+
+// Commands はこれまでに受け付けたコマンド名の一覧を返す
+func (m *Module) Commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.commands...)
+}
+
+// SetRegister は仮想レジスタの値を書き換える（モジュール再起動などの模倣用）
+func (m *Module) SetRegister(name, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.regs[name] = value
+}
+
+// Register はレジスタの現在値を返す
+func (m *Module) Register(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.regs[name]
+}
+
+// IPAddr はモジュール自身のリンクローカルアドレスを返す
+func (m *Module) IPAddr() string {
+	return LinkLocalAddr(m.MACAddr)
+}
+
+func (m *Module) println(lines ...string) {
+	for _, line := range lines {
+		select {
+		case m.out <- line + "\r\n":
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Module) writeLoop() {
+	defer m.modW.Close()
+	for {
+		select {
+		case s := <-m.out:
+			if _, err := io.WriteString(m.modW, s); err != nil {
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Module) readLoop() {
+	defer m.modR.Close()
+	r := bufio.NewReader(m.modR)
+	for {
+		args, data, err := m.readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		m.mu.Lock()
+		m.commands = append(m.commands, args[0])
+		f := m.takeFault(args[0])
+		m.mu.Unlock()
+		if f != nil {
+			m.println(f.Lines...)
+			continue
+		}
+		m.println(m.handle(args, data)...)
+	}
+}
+
+// readCommand はコマンドを1つ読む
+// SKSENDTOなどのバイナリデータはデータ長を見て読み込む
+func (m *Module) readCommand(r *bufio.Reader) (args []string, data []byte, err error) {
+	var token []byte
+	for {
+		var c byte
+		c, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case '\r':
+			continue
+		case ' ', '\n':
+			if len(token) > 0 {
+				args = append(args, string(token))
+				token = nil
+			}
+			if c == '\n' {
+				return
+			}
+			if i := m.dataLenIndex(args); i > 0 && len(args) == i+1 {
+				var n int64
+				n, err = strconv.ParseInt(args[i], 16, 32)
+				if err != nil {
+					return
+				}
+				data = make([]byte, n)
+				if _, err = io.ReadFull(r, data); err != nil {
+					return
+				}
+				// データの後ろの改行まで読み捨てる
+				_, err = r.ReadString('\n')
+				return
+			}
+		default:
+			token = append(token, c)
+		}
+	}
+}
+
+// dataLenIndex はバイナリデータを伴うコマンドのデータ長引数の位置を返す
+func (m *Module) dataLenIndex(args []string) int {
+	if len(args) == 0 {
+		return 0
+	}
+	switch args[0] {
+	case "SKSENDTO":
+		if m.DualStack {
+			return 6
+		}
+		return 5
+	case "SKSEND":
+		return 2
+	}
+	return 0
+}
+
+func (m *Module) takeFault(cmd string) *Fault {
+	for i, f := range m.faults {
+		if f.Command != cmd {
+			continue
+		}
+		f.Times--
+		if f.Times <= 0 {
+			m.faults = append(m.faults[:i], m.faults[i+1:]...)
+		}
+		return f
+	}
+	return nil
+}
+
+func (m *Module) handle(args []string, data []byte) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch args[0] {
+	case "SKVER":
+		return []string{"EVER " + m.Version, "OK"}
+	case "SKAPPVER":
+		if m.AppVersion == "" {
+			return []string{FailLine(4)}
+		}
+		return []string{"EAPPVER " + m.AppVersion, "OK"}
+	case "SKINFO":
+		info := fmt.Sprintf("EINFO %s %s %s %s FFFE", m.IPAddr(), m.MACAddr, m.regs["S02"], m.regs["S03"])
+		if m.DualStack {
+			info += " 0"
+		}
+		return []string{info, "OK"}
+	case "SKSREG":
+		return m.handleSREG(args)
+	case "ROPT":
+		if m.ascii {
+			return []string{"OK 01"}
+		}
+		return []string{"OK 00"}
+	case "WOPT":
+		if len(args) != 2 {
+			return []string{"FAIL ER05"}
+		}
+		switch args[1] {
+		case "00", "01":
+			m.ascii = args[1] == "01"
+			return []string{"OK"}
+		}
+		return []string{"FAIL ER06"}
+	case "SKSAVE":
+		m.saved = map[string]string{}
+		for k, v := range m.regs {
+			m.saved[k] = v
+		}
+		return []string{"OK"}
+	case "SKLOAD":
+		if m.saved == nil {
+			return []string{"FAIL ER10"}
+		}
+		for k, v := range m.saved {
+			m.regs[k] = v
+		}
+		return []string{"OK"}
+	case "SKERASE":
+		m.saved = nil
+		return []string{"OK"}
+	case "SKRESET":
+		// SFFが1の設定が保存されていれば、再起動時に自動で読み込む
+		m.regs = defaultRegisters()
+		if m.saved != nil && m.saved["SFF"] == "1" {
+			for k, v := range m.saved {
+				m.regs[k] = v
+			}
+		}
+		m.id, m.password, m.paa, m.nbrs = "", "", "", nil
+		m.udpPorts = []int{3610, 716, 0, 0, 0, 0}
+		m.tcpPorts = make([]int, maxTCPHandle)
+		m.tcpConns = map[int]*tcpConn{}
+		m.joined = false
+		return []string{"OK"}
+	case "SKTERM":
+		if !m.joined {
+			return []string{"FAIL ER10"}
+		}
+		m.joined, m.paa = false, ""
+		return []string{"OK", m.event(0x27, m.Meter.IPAddr(), "")}
+	case "SKSETRBID":
+		if len(args) != 2 {
+			return []string{"FAIL ER05"}
+		}
+		m.id = args[1]
+		return []string{"OK"}
+	case "SKSETPWD":
+		if len(args) != 3 {
+			return []string{"FAIL ER05"}
+		}
+		m.password = args[2]
+		return []string{"OK"}
+	case "SKSCAN":
+		return m.handleScan(args)
+	case "SKLL64":
+		if len(args) != 2 {
+			return []string{"FAIL ER05"}
+		}
+		ipAddr := LinkLocalAddr(args[1])
+		if ipAddr == "" {
+			return []string{"FAIL ER06"}
+		}
+		return []string{ipAddr}
+	case "SKJOIN":
+		return m.handleJoin(args)
+	case "SKREJOIN":
+		if len(args) != 1 {
+			return []string{"FAIL ER05"}
+		}
+		if m.paa == "" {
+			return []string{"FAIL ER10"}
+		}
+		return m.handleJoin([]string{"SKJOIN", m.paa})
+	case "SKTABLE":
+		return m.handleTable(args)
+	case "SKUDPPORT":
+		if len(args) != 3 {
+			return []string{"FAIL ER05"}
+		}
+		handle, err1 := strconv.Atoi(args[1])
+		port, err2 := strconv.ParseUint(args[2], 16, 16)
+		if err1 != nil || err2 != nil || handle < 1 || handle > len(m.udpPorts) {
+			return []string{"FAIL ER06"}
+		}
+		m.udpPorts[handle-1] = int(port)
+		return []string{"OK"}
+	case "SKTCPPORT":
+		if len(args) != 3 {
+			return []string{"FAIL ER05"}
+		}
+		index, err1 := strconv.Atoi(args[1])
+		port, err2 := strconv.ParseUint(args[2], 16, 16)
+		if err1 != nil || err2 != nil || index < 1 || index > len(m.tcpPorts) {
+			return []string{"FAIL ER06"}
+		}
+		m.tcpPorts[index-1] = int(port)
+		return []string{"OK"}
+	case "SKADDNBR":
+		if len(args) != 3 {
+			return []string{"FAIL ER05"}
+		}
+		if len(args[1]) != 39 || len(args[2]) != 16 {
+			return []string{"FAIL ER06"}
+		}
+		m.nbrs = append(m.nbrs, fmt.Sprintf("%s %s FFFF", args[1], args[2]))
+		return []string{"OK"}
+	case "SKSENDTO":
+		return m.handleSendTo(args, data)
+	case "SKCONNECT":
+		return m.handleConnect(args)
+	case "SKSEND":
+		return m.handleTCPSend(args, data)
+	case "SKCLOSE":
+		if len(args) != 2 {
+			return []string{"FAIL ER05"}
+		}
+		handle, err := strconv.Atoi(args[1])
+		if err != nil || m.tcpConns[handle] == nil {
+			return []string{"FAIL ER06"}
+		}
+		delete(m.tcpConns, handle)
+		return []string{"OK", fmt.Sprintf("ETCP 3 %02X", handle)}
+	}
+	return []string{"FAIL ER04"}
+}
+
+func (m *Module) handleSREG(args []string) []string {
+	switch len(args) {
+	case 2:
+		v, ok := m.regs[args[1]]
+		if !ok {
+			return []string{"FAIL ER06"}
+		}
+		return []string{"ESREG " + v, "OK"}
+	case 3:
+		if _, ok := m.regs[args[1]]; !ok {
+			return []string{"FAIL ER06"}
+		}
+		m.regs[args[1]] = args[2]
+		return []string{"OK"}
+	}
+	return []string{"FAIL ER05"}
+}
+
+func (m *Module) handleScan(args []string) []string {
+	if (m.DualStack && len(args) != 5) || (!m.DualStack && len(args) != 4) {
+		return []string{"FAIL ER05"}
+	}
+	mask, err := strconv.ParseUint(args[2], 16, 32)
+	if err != nil {
+		return []string{"FAIL ER06"}
+	}
+	duration, err := strconv.ParseUint(args[3], 16, 8)
+	if err != nil {
+		return []string{"FAIL ER06"}
+	}
+	lines := []string{"OK"}
+	switch args[1] {
+	case "0":
+		// EDスキャン
+		var values []string
+		for ch := 0x21; ch <= 0x3C; ch++ {
+			if mask&(1<<uint(ch-0x21)) == 0 {
+				continue
+			}
+			v, ok := m.EDValues[ch]
+			if !ok {
+				v = 0x20
+			}
+			values = append(values, fmt.Sprintf("%02X %02X", ch, v))
+		}
+		return append(lines, "EEDSCAN", strings.Join(values, " "), m.event(0x1F, m.IPAddr(), ""))
+	case "2":
+	default:
+		return lines
+	}
+	for _, mt := range append([]*Meter{m.Meter}, m.Others...) {
+		if mt == nil || mask&(1<<uint(mt.Channel-0x21)) == 0 || int(duration) < mt.MinScanDuration {
+			continue
+		}
+		lines = append(lines,
+			m.event(0x20, mt.IPAddr(), ""),
+			"EPANDESC",
+			fmt.Sprintf("  Channel:%02X", mt.Channel),
+			"  Channel Page:09",
+			fmt.Sprintf("  Pan ID:%04X", mt.PanID),
+			"  Addr:"+mt.MACAddr,
+			fmt.Sprintf("  LQI:%02X", mt.LQI),
+		)
+		if mt.PairID != "" {
+			lines = append(lines, "  PairID:"+mt.PairID)
+		}
+	}
+	return append(lines, m.event(0x22, m.IPAddr(), ""))
+}
+
+func (m *Module) handleJoin(args []string) []string {
+	if len(args) != 2 {
+		return []string{"FAIL ER05"}
+	}
+	mt := m.Meter
+	if mt == nil || args[1] != mt.IPAddr() {
+		return []string{"OK", m.event(0x24, args[1], "")}
+	}
+	if m.id != mt.ID || m.password != mt.Password ||
+		m.regs["S02"] != fmt.Sprintf("%02X", mt.Channel) ||
+		m.regs["S03"] != fmt.Sprintf("%04X", mt.PanID) {
+		return []string{"OK", m.event(0x21, args[1], "00"), m.event(0x24, args[1], "")}
+	}
+	m.joined, m.paa = true, args[1]
+	return []string{
+		"OK",
+		m.event(0x21, args[1], "00"),
+		m.event(0x02, args[1], ""),
+		m.event(0x21, args[1], "00"),
+		m.event(0x25, args[1], ""),
+	}
+}
+
+func (m *Module) handleTable(args []string) []string {
+	if len(args) != 2 {
+		return []string{"FAIL ER05"}
+	}
+	switch args[1] {
+	case "1":
+		return []string{"EADDR", m.IPAddr(), "OK"}
+	case "2":
+		lines := []string{"ENEIGHBOR"}
+		if m.joined {
+			lines = append(lines, fmt.Sprintf("%s %s FFFF", m.Meter.IPAddr(), m.Meter.MACAddr))
+		}
+		lines = append(lines, m.nbrs...)
+		return append(lines, "OK")
+	case "E":
+		lines := []string{"EPORT"}
+		for _, port := range m.udpPorts {
+			lines = append(lines, strconv.Itoa(port))
+		}
+		// 空行の後にSKTCPPORTで設定したTCPの待ち受けポートが並ぶ
+		// SKCONNECTで確立した接続のローカルポートは含まれない
+		lines = append(lines, "")
+		for _, port := range m.tcpPorts {
+			lines = append(lines, strconv.Itoa(port))
+		}
+		return append(lines, "OK")
+	}
+	return []string{"FAIL ER06"}
+}
+
+func (m *Module) handleSendTo(args []string, data []byte) []string {
+	if (m.DualStack && len(args) != 7) || (!m.DualStack && len(args) != 6) {
+		return []string{"FAIL ER05"}
+	}
+	if m.regs["SFB"] == "1" {
+		return []string{FailLine(10)}
+	}
+	ipAddr := args[2]
+	mt := m.Meter
+	if mt == nil || ipAddr != mt.IPAddr() {
+		return []string{m.event(0x21, ipAddr, "01"), "OK"}
+	}
+	if !m.joined {
+		return []string{m.event(0x21, ipAddr, "02"), "OK"}
+	}
+	handle, err := strconv.Atoi(args[1])
+	if err != nil || handle < 1 || handle > len(m.udpPorts) {
+		return []string{"FAIL ER06"}
+	}
+	lport := m.udpPorts[handle-1]
+	if lport == 0 {
+		return []string{FailLine(10)}
+	}
+	lines := []string{m.event(0x21, ipAddr, "00"), "OK"}
+	switch args[3] {
+	case "0007":
+		// echoポートは受け取ったデータをそのまま送り返す（診断用）
+		return append(lines, m.erxudp(mt, 7, lport, args[4] == "1", data))
+	case "0E1A":
+		req, err := smartmeter.ParseFrame(data)
+		if err != nil {
+			return lines
+		}
+		res := mt.respond(req)
+		if res == nil {
+			return lines
+		}
+		return append(lines, m.erxudp(mt, 3610, 3610, true, res.Build()))
+	}
+	return lines
+}
+
+// tcpConn はSKCONNECTで確立したTCP接続
+type tcpConn struct {
+	ipAddr string
+	rport  int
+	lport  int
+}
+
+// maxTCPHandle は同時に確立できるTCP接続の数
+const maxTCPHandle = 4
+
+// handleConnect はスマートメーターのechoポート（7）へのTCP接続だけを受け付ける
+func (m *Module) handleConnect(args []string) []string {
+	if len(args) != 4 {
+		return []string{"FAIL ER05"}
+	}
+	rport, err1 := strconv.ParseUint(args[2], 16, 16)
+	lport, err2 := strconv.ParseUint(args[3], 16, 16)
+	if err1 != nil || err2 != nil || len(args[1]) != 39 {
+		return []string{"FAIL ER06"}
+	}
+	handle := 0
+	for h := 1; h <= maxTCPHandle; h++ {
+		if m.tcpConns[h] == nil {
+			handle = h
+			break
+		}
+	}
+	if handle == 0 || !m.joined {
+		return []string{FailLine(10)}
+	}
+	mt := m.Meter
+	if args[1] != mt.IPAddr() || rport != 7 {
+		return []string{"OK", fmt.Sprintf("ETCP 4 %02X", handle)}
+	}
+	m.tcpConns[handle] = &tcpConn{ipAddr: args[1], rport: int(rport), lport: int(lport)}
+	return []string{"OK", fmt.Sprintf("ETCP 1 %02X %s %s %s", handle, args[1], args[2], args[3])}
+}
+
+// handleTCPSend は送られたデータをそのままERXTCPで送り返す
+func (m *Module) handleTCPSend(args []string, data []byte) []string {
+	if len(args) != 3 {
+		return []string{"FAIL ER05"}
+	}
+	handle, err := strconv.Atoi(args[1])
+	if err != nil {
+		return []string{"FAIL ER06"}
+	}
+	c := m.tcpConns[handle]
+	if c == nil {
+		return []string{FailLine(10)}
+	}
+	return []string{
+		"OK",
+		fmt.Sprintf("ETCP 5 %02X 00", handle),
+		fmt.Sprintf("ERXTCP %s %04X %04X %04X %s", c.ipAddr, c.rport, c.lport, len(data), m.display(data)),
+	}
+}
+
+// CloseTCP は相手からのTCP切断を模倣し、全ての接続についてETCP 3を出力する
+func (m *Module) CloseTCP() {
+	m.mu.Lock()
+	var lines []string
+	for handle := range m.tcpConns {
+		lines = append(lines, fmt.Sprintf("ETCP 3 %02X", handle))
+		delete(m.tcpConns, handle)
+	}
+	m.mu.Unlock()
+	m.println(lines...)
+}
+
+// erxudp はスマートメーターから受信したERXUDP行を作る
+func (m *Module) erxudp(mt *Meter, rport, lport int, secured bool, data []byte) string {
+	flags := "0"
+	if secured {
+		flags = "1"
+	}
+	// デュアルスタックモジュールではSIDEが付き、ファームウェアによってはLQIも付く
+	if m.DualStack {
+		flags += " 0"
+		if !m.OmitLQI {
+			flags = fmt.Sprintf("%02X %s", mt.LQI, flags)
+		}
+	}
+	return fmt.Sprintf("ERXUDP %s %s %04X %04X %s %s %04X %s",
+		mt.IPAddr(), m.IPAddr(), rport, lport, mt.MACAddr, flags, len(data), m.display(data))
+}
+
+// display はWOPTの設定に従ってデータ部を出力用の文字列にする
+func (m *Module) display(data []byte) string {
+	if m.ascii {
+		return fmt.Sprintf("%X", data)
+	}
+	return string(data)
+}
+
+// event はEVENT行を作る。デュアルスタックモジュールではSIDEが付く
+func (m *Module) event(code int, sender string, param string) string {
+	s := fmt.Sprintf("EVENT %02X %s", code, sender)
+	if m.DualStack {
+		s += " 0"
+	}
+	if param != "" {
+		s += " " + param
+	}
+	return s
+}
+
+func (mt *Meter) respond(req *smartmeter.Frame) *smartmeter.Frame {
+	if mt.Handler != nil {
+		return mt.Handler(req)
+	}
+	if req.ESV != smartmeter.Get {
+		return nil
+	}
+	props := make([]*smartmeter.Property, len(req.Properties))
+	for i, p := range req.Properties {
+		props[i] = smartmeter.NewProperty(p.EPC, mt.Properties[p.EPC])
+	}
+	return &smartmeter.Frame{
+		TID:        req.TID,
+		SEOJ:       req.DEOJ,
+		DEOJ:       req.SEOJ,
+		ESV:        smartmeter.GetRes,
+		Properties: props,
+	}
+}
+
+// FailLine はSKSTACKのエラー応答行を返す（例: FailLine(10) == "FAIL ER10"）
+func FailLine(code int) string {
+	return fmt.Sprintf("FAIL ER%02d", code)
+}
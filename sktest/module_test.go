@@ -0,0 +1,41 @@
+package sktest
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestLinkLocalAddr(t *testing.T) {
+	got := LinkLocalAddr("001C6400030C12A4")
+	expected := "FE80:0000:0000:0000:021C:6400:030C:12A4"
+	if got != expected {
+		t.Errorf("LinkLocalAddr() differ: %q != %q", got, expected)
+	}
+}
+
+func TestReadCommandBinaryData(t *testing.T) {
+	m := &Module{}
+	input := "SKSENDTO 1 FE80:0000:0000:0000:021C:6400:030C:12A4 0E1A 1 0004 \r\n\x00\x01\r\nSKVER\r\n"
+	r := bufio.NewReader(bytes.NewBufferString(input))
+
+	args, data, err := m.readCommand(r)
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	if len(args) != 6 || args[0] != "SKSENDTO" {
+		t.Errorf("Unexpected args: %q", args)
+	}
+	if !reflect.DeepEqual(data, []byte("\r\n\x00\x01")) {
+		t.Errorf("Data differ: %q", data)
+	}
+
+	args, _, err = m.readCommand(r)
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	if !reflect.DeepEqual(args, []string{"SKVER"}) {
+		t.Errorf("Unexpected args: %q", args)
+	}
+}
@@ -0,0 +1,124 @@
+package smartmeter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SessionInfo はスキャンで見つけた接続先の情報
+// 保存しておけば、次回起動時にスキャンを省略して直接Joinできる
+type SessionInfo struct {
+	Channel string `json:"channel"`  // チャンネル（16進2桁）
+	PanID   string `json:"pan_id"`   // PAN ID（16進4桁）
+	MACAddr string `json:"mac_addr"` // スマートメーターのMACアドレス（16進16桁）
+	IPAddr  string `json:"ip_addr"`  // スマートメーターのIPv6アドレス
+}
+
+// SessionStore は接続先の情報を保存・読み込みするインターフェース
+type SessionStore interface {
+	// Load は保存された接続先の情報を返す。保存されていなければnilを返す
+	Load() (*SessionInfo, error)
+	// Save は接続先の情報を保存する
+	Save(info *SessionInfo) error
+}
+
+// FileSessionStore は接続先の情報をJSONファイルに保存するSessionStore
+type FileSessionStore struct {
+	Path string
+}
+
+// NewFileSessionStore は FileSessionStore構造体のコンストラクタ関数
+func NewFileSessionStore(path string) *FileSessionStore {
+	return &FileSessionStore{Path: path}
+}
+
+func (s *FileSessionStore) Load() (*SessionInfo, error) {
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	info := &SessionInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (s *FileSessionStore) Save(info *SessionInfo) error {
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 書き込み途中で電源が落ちても壊れたファイルが残らないよう、一時ファイルからrenameする
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// joinCached は保存された接続先の情報を使い、スキャンせずに直接Joinする
+func (d *Device) joinCached(ctx context.Context, opts ...Option) (err error) {
+	info, err := d.store.Load()
+	if err != nil {
+		return
+	}
+	if info == nil || info.Channel == "" || info.PanID == "" || info.IPAddr == "" {
+		return errors.New("No cached session")
+	}
+	if err = d.SetIDContext(ctx, opts...); err != nil {
+		return
+	}
+	if err = d.SetPasswordContext(ctx, opts...); err != nil {
+		return
+	}
+	if err = d.SetRegisterValueContext(ctx, "S02", info.Channel, opts...); err != nil {
+		return
+	}
+	if err = d.SetRegisterValueContext(ctx, "S03", info.PanID, opts...); err != nil {
+		return
+	}
+	d.updateTarget(func(t *SessionInfo) {
+		*t = *info
+	})
+	return d.JoinContext(ctx, opts...)
+}
+
+// saveSession は現在の接続先の情報を保存する
+func (d *Device) saveSession() {
+	info := d.SessionInfo()
+	if err := d.store.Save(&info); err != nil {
+		d.warnf("Failed to save session: %+v", err)
+	}
+}
+
+// SessionInfo は現在の接続先の情報を返す
+// Channel, IPAddrなどのフィールドはScan()や自動再接続で書き換わるので、他のgoroutineが使用中のDeviceではこちらで読む
+func (d *Device) SessionInfo() SessionInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return SessionInfo{Channel: d.Channel, PanID: d.panID, MACAddr: d.macAddr, IPAddr: d.IPAddr}
+}
+
+// updateTarget は接続先の情報をロックを取って書き換える
+func (d *Device) updateTarget(fn func(t *SessionInfo)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := SessionInfo{Channel: d.Channel, PanID: d.panID, MACAddr: d.macAddr, IPAddr: d.IPAddr}
+	fn(&t)
+	d.Channel, d.panID, d.macAddr, d.IPAddr = t.Channel, t.PanID, t.MACAddr, t.IPAddr
+}
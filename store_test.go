@@ -0,0 +1,97 @@
+package smartmeter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	smartmeter "github.com/hnw/go-smartmeter"
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := smartmeter.NewFileSessionStore(filepath.Join(dir, "session.json"))
+
+	info, err := store.Load()
+	if err != nil || info != nil {
+		t.Errorf("Load() should return nil for missing file: %+v, %v", info, err)
+	}
+	expected := &smartmeter.SessionInfo{
+		Channel: "33",
+		PanID:   "8888",
+		MACAddr: "001C6400030C12A4",
+		IPAddr:  "FE80:0000:0000:0000:021C:6400:030C:12A4",
+	}
+	if err := store.Save(expected); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	info, err = store.Load()
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("Loaded session differ: %+v != %+v", info, expected)
+	}
+}
+
+func TestAuthenticateWithSessionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.json")
+	meter := sktest.NewMeter()
+
+	// 初回はスキャンして接続先を保存する
+	m := sktest.NewModule()
+	m.Meter = meter
+	dev := newTestDevice(t, m, smartmeter.SessionFile(path))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if n := countCommand(m, "SKSCAN"); n != 1 {
+		t.Errorf("SKSCAN count differ: %d != 1", n)
+	}
+	m.Close()
+
+	// 再起動後は保存された接続先に直接Joinする
+	m = sktest.NewModule()
+	m.Meter = meter
+	dev = newTestDevice(t, m, smartmeter.SessionFile(path))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if n := countCommand(m, "SKSCAN"); n != 0 {
+		t.Errorf("SKSCAN should be skipped: %d", n)
+	}
+	if dev.IPAddr != meter.IPAddr() {
+		t.Errorf("IPAddr differ: %q != %q", dev.IPAddr, meter.IPAddr())
+	}
+	m.Close()
+
+	// メーターが変わっていたらスキャンし直す
+	meter.Channel = 0x21
+	meter.MACAddr = "001C640003AB0001"
+	m = sktest.NewModule()
+	m.Meter = meter
+	defer m.Close()
+	dev = newTestDevice(t, m, smartmeter.SessionFile(path))
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if n := countCommand(m, "SKSCAN"); n != 1 {
+		t.Errorf("SKSCAN count differ: %d != 1", n)
+	}
+	info, _ := smartmeter.NewFileSessionStore(path).Load()
+	if info == nil || info.Channel != "21" || info.IPAddr != meter.IPAddr() {
+		t.Errorf("Session was not updated: %+v", info)
+	}
+}
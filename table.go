@@ -0,0 +1,173 @@
+package smartmeter
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NeighborEntry はネイバーキャッシュ（SKTABLE 2）の1エントリ
+type NeighborEntry struct {
+	IPAddr  net.IP           // IPv6アドレス
+	MACAddr net.HardwareAddr // MACアドレス（64bit）
+	Addr16  uint16           // ショートアドレス。未割り当てならFFFF
+}
+
+func (e NeighborEntry) String() string {
+	return fmt.Sprintf("%s %s %04X", e.IPAddr, e.MACAddr, e.Addr16)
+}
+
+// PortTable はUDPとTCPの待ち受けポート（SKTABLE E）
+// スライスの添字+1がSKUDPPORTなどで指定するハンドル番号に対応する。0は未使用
+type PortTable struct {
+	UDP []uint16
+	TCP []uint16
+}
+
+// formatIPv6 はIPv6アドレスをSKSTACK-IPの書式（FE80:0000:...）に変換する
+func formatIPv6(ip net.IP) string {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%02X%02X", ip16[2*i], ip16[2*i+1])
+	}
+	return strings.Join(groups, ":")
+}
+
+// tableLines はSKTABLEのレスポンスから、見出し行（EADDRなど）とOKの間の行を返す
+func tableLines(res string, header string) (lines []string, err error) {
+	all := strings.Split(res, "\n")
+	for i, line := range all {
+		if line != header {
+			continue
+		}
+		for _, l := range all[i+1:] {
+			if l == "OK" {
+				break
+			}
+			lines = append(lines, l)
+		}
+		return
+	}
+	return nil, fmt.Errorf("Unexpected response for SKTABLE: %q", res)
+}
+
+func (d *Device) NeighborTable(opts ...Option) (entries []NeighborEntry, err error) {
+	return d.NeighborTableContext(context.Background(), opts...)
+}
+
+// NeighborTableContext はネイバーキャッシュ（SKTABLE 2）を返す
+func (d *Device) NeighborTableContext(ctx context.Context, opts ...Option) (entries []NeighborEntry, err error) {
+	res, err := d.QuerySKCommandContext(ctx, "SKTABLE 2", opts...)
+	if err != nil {
+		return
+	}
+	lines, err := tableLines(res, "ENEIGHBOR")
+	if err != nil {
+		return
+	}
+	return parseNeighborTable(lines)
+}
+
+// parseNeighborTable は「<IPADDR> <ADDR64> <ADDR16>」の行を解析する
+func parseNeighborTable(lines []string) (entries []NeighborEntry, err error) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Unexpected neighbor entry: %s", line)
+		}
+		ip := net.ParseIP(fields[0])
+		mac, err1 := hex.DecodeString(fields[1])
+		addr16, err2 := strconv.ParseUint(fields[2], 16, 16)
+		if ip == nil || len(mac) != 8 || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Unexpected neighbor entry: %s", line)
+		}
+		entries = append(entries, NeighborEntry{IPAddr: ip, MACAddr: net.HardwareAddr(mac), Addr16: uint16(addr16)})
+	}
+	return
+}
+
+func (d *Device) AddressTable(opts ...Option) (addrs []net.IP, err error) {
+	return d.AddressTableContext(context.Background(), opts...)
+}
+
+// AddressTableContext は自端末に割り当てられたIPv6アドレスの一覧（SKTABLE 1）を返す
+func (d *Device) AddressTableContext(ctx context.Context, opts ...Option) (addrs []net.IP, err error) {
+	res, err := d.QuerySKCommandContext(ctx, "SKTABLE 1", opts...)
+	if err != nil {
+		return
+	}
+	lines, err := tableLines(res, "EADDR")
+	if err != nil {
+		return
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		ip := net.ParseIP(strings.TrimSpace(line))
+		if ip == nil {
+			return nil, fmt.Errorf("Unexpected address entry: %s", line)
+		}
+		addrs = append(addrs, ip)
+	}
+	return
+}
+
+func (d *Device) PortTable(opts ...Option) (ports *PortTable, err error) {
+	return d.PortTableContext(context.Background(), opts...)
+}
+
+// PortTableContext はUDPとTCPの待ち受けポート（SKTABLE E）を返す
+// EPORTの後にUDPのポートが並び、空行を挟んでTCPのポートが並ぶ
+func (d *Device) PortTableContext(ctx context.Context, opts ...Option) (ports *PortTable, err error) {
+	res, err := d.QuerySKCommandContext(ctx, "SKTABLE E", opts...)
+	if err != nil {
+		return
+	}
+	lines, err := tableLines(res, "EPORT")
+	if err != nil {
+		return
+	}
+	ports = &PortTable{}
+	list := &ports.UDP
+	for _, line := range lines {
+		if line == "" {
+			list = &ports.TCP
+			continue
+		}
+		port, err := strconv.ParseUint(strings.TrimSpace(line), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected port entry: %s", line)
+		}
+		*list = append(*list, uint16(port))
+	}
+	return
+}
+
+func (d *Device) AddNeighbor(ip net.IP, mac net.HardwareAddr, opts ...Option) (err error) {
+	return d.AddNeighborContext(context.Background(), ip, mac, opts...)
+}
+
+// AddNeighborContext はネイバーキャッシュにIPv6アドレスとMACアドレスの組を登録する（SKADDNBR）
+// 既知のスマートメーターをアドレス要請なしで送信先にできる
+func (d *Device) AddNeighborContext(ctx context.Context, ip net.IP, mac net.HardwareAddr, opts ...Option) (err error) {
+	if ip.To16() == nil || ip.To4() != nil {
+		return fmt.Errorf("Invalid IPv6 address: %s", ip)
+	}
+	if len(mac) != 8 {
+		return fmt.Errorf("Invalid MAC address: %s", mac)
+	}
+	cmd := fmt.Sprintf("SKADDNBR %s %X", formatIPv6(ip), []byte(mac))
+	_, err = d.QuerySKCommandContext(ctx, cmd, opts...)
+	return
+}
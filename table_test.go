@@ -0,0 +1,68 @@
+package smartmeter_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestNeighborTable(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	entries, err := dev.NeighborTable()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("NeighborTable() should be empty before join: %v, %v", entries, err)
+	}
+	if _, err := dev.GetNeibourIP(); err == nil {
+		t.Errorf("GetNeibourIP() should fail without neighbors")
+	}
+
+	ip := net.ParseIP("fe80::21c:6400:30c:12a4")
+	mac, _ := net.ParseMAC("00:1c:64:00:03:0c:12:a4")
+	if err := dev.AddNeighbor(ip, mac); err != nil {
+		t.Fatalf("AddNeighbor() error: %v", err)
+	}
+	entries, err = dev.NeighborTable()
+	if err != nil {
+		t.Fatalf("NeighborTable() error: %v", err)
+	}
+	if len(entries) != 1 || !entries[0].IPAddr.Equal(ip) || entries[0].MACAddr.String() != mac.String() || entries[0].Addr16 != 0xFFFF {
+		t.Errorf("Unexpected neighbor table: %v", entries)
+	}
+	ipAddr, err := dev.GetNeibourIP()
+	if err != nil || ipAddr != m.Meter.IPAddr() {
+		t.Errorf("GetNeibourIP() differ: %q, %v", ipAddr, err)
+	}
+
+	if err := dev.AddNeighbor(net.ParseIP("192.0.2.1"), mac); err == nil {
+		t.Errorf("AddNeighbor() should reject IPv4 address")
+	}
+}
+
+func TestAddressAndPortTable(t *testing.T) {
+	m := sktest.NewModule()
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	addrs, err := dev.AddressTable()
+	if err != nil {
+		t.Fatalf("AddressTable() error: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "fe80::21d:1290:1234:5678" {
+		t.Errorf("Unexpected address table: %v", addrs)
+	}
+
+	ports, err := dev.PortTable()
+	if err != nil {
+		t.Fatalf("PortTable() error: %v", err)
+	}
+	if !reflect.DeepEqual(ports.UDP, []uint16{3610, 716, 0, 0, 0, 0}) || !reflect.DeepEqual(ports.TCP, []uint16{0, 0, 0, 0}) {
+		t.Errorf("Unexpected port table: %+v", ports)
+	}
+}
@@ -0,0 +1,401 @@
+package smartmeter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * 参考資料
+ *   SKSTACK IP コマンドリファレンスマニュアル「SKCONNECT」「SKSEND」「SKCLOSE」「ETCP」「ERXTCP」
+ */
+
+// ETCPのステータス
+const (
+	tcpStatusConnected = 1 // 接続が確立した
+	tcpStatusClosed    = 3 // 接続が切断された
+	tcpStatusFailed    = 4 // 接続できなかった
+	tcpStatusSent      = 5 // SKSENDの送信が完了した（<RESULT> 00: 成功）
+)
+
+// maxTCPSendLen はSKSEND 1回で送るデータの最大長
+const maxTCPSendLen = 1024
+
+// tcpEvent はETCPイベント
+// 書式: ETCP <STATUS> <HANDLE> [<IPADDR> <RPORT> <LPORT>] または ETCP 5 <HANDLE> <RESULT>
+type tcpEvent struct {
+	Status int
+	Handle int
+	IPAddr net.IP
+	RPort  uint16
+	LPort  uint16
+	Result int
+}
+
+func parseTCPEvent(line string) (ev *tcpEvent, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "ETCP" {
+		return nil, fmt.Errorf("Unknown ETCP format: %s", line)
+	}
+	status, err1 := strconv.ParseUint(fields[1], 16, 8)
+	handle, err2 := strconv.ParseUint(fields[2], 16, 8)
+	if err1 != nil || err2 != nil {
+		return nil, errors.New("ETCP parse error (not a hexadecimal) : " + line)
+	}
+	ev = &tcpEvent{Status: int(status), Handle: int(handle)}
+	switch {
+	case ev.Status == tcpStatusSent && len(fields) == 4:
+		result, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return nil, errors.New("ETCP parse error (not a hexadecimal) : " + line)
+		}
+		ev.Result = int(result)
+	case len(fields) == 6:
+		ev.IPAddr = net.ParseIP(fields[3])
+		rport, err1 := strconv.ParseUint(fields[4], 16, 16)
+		lport, err2 := strconv.ParseUint(fields[5], 16, 16)
+		if ev.IPAddr == nil || err1 != nil || err2 != nil {
+			return nil, errors.New("ETCP parse error (invalid address) : " + line)
+		}
+		ev.RPort, ev.LPort = uint16(rport), uint16(lport)
+	case len(fields) != 3:
+		return nil, fmt.Errorf("Unknown ETCP format: %s", line)
+	}
+	return
+}
+
+// tcpSegment はERXTCPで受信したデータ
+// 書式: ERXTCP <SENDER> <RPORT> <LPORT> <DATALEN> <DATA>
+type tcpSegment struct {
+	Src     net.IP
+	SrcPort uint16
+	DstPort uint16
+	Data    []byte
+}
+
+func parseTCPSegment(line string, mode DisplayMode) (s *tcpSegment, err error) {
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) != 6 || fields[0] != "ERXTCP" {
+		return nil, fmt.Errorf("Unknown ERXTCP format: %s", line)
+	}
+	s = &tcpSegment{Src: net.ParseIP(fields[1])}
+	rport, err1 := strconv.ParseUint(fields[2], 16, 16)
+	lport, err2 := strconv.ParseUint(fields[3], 16, 16)
+	dataLen, err3 := strconv.ParseUint(fields[4], 16, 16)
+	if s.Src == nil || err1 != nil || err2 != nil || err3 != nil {
+		return nil, errors.New("ERXTCP parse error : " + line)
+	}
+	s.SrcPort, s.DstPort = uint16(rport), uint16(lport)
+	if s.Data, err = decodeData(fields[5], int(dataLen), mode); err != nil {
+		return nil, fmt.Errorf("ERXTCP parse error (%v) : %s", err, line)
+	}
+	return
+}
+
+// tcpTimeoutError はTCPConnの読み書きが期限を過ぎたときに返る
+type tcpTimeoutError struct{}
+
+func (tcpTimeoutError) Error() string   { return "TCP deadline exceeded" }
+func (tcpTimeoutError) Timeout() bool   { return true }
+func (tcpTimeoutError) Temporary() bool { return true }
+
+// tcpConn はSKSTACK-IPのTCP接続をnet.Connとして扱う
+type tcpConn struct {
+	d      *Device
+	handle int
+	laddr  *net.TCPAddr
+	raddr  *net.TCPAddr
+	cancel func()
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	eof           bool // 相手から切断された
+	readDeadline  time.Time
+	writeDeadline time.Time
+	wake          chan struct{} // 受信や期限の変更を待っているReadに知らせる
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// tcpHandleInUse は確立済みのTCP接続のハンドルか返す
+func (d *Device) tcpHandleInUse(handle int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tcpHandles[handle]
+}
+
+func (d *Device) setTCPHandle(handle int, inUse bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tcpHandles == nil {
+		d.tcpHandles = map[int]bool{}
+	}
+	if inUse {
+		d.tcpHandles[handle] = true
+	} else {
+		delete(d.tcpHandles, handle)
+	}
+}
+
+// nextTCPPort はSKCONNECTで使うローカルポートを返す
+func (d *Device) nextTCPPort() uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	port := 0xC000 + d.tcpPorts%0x4000
+	d.tcpPorts++
+	return uint16(port)
+}
+
+// DialTCP はSKCONNECTでTCP接続を確立し、net.Connとして返す
+// デュアルスタックモジュールのHAN側などで、既存のGoのコードからTCPで通信するために使う
+func (d *Device) DialTCP(ctx context.Context, ip net.IP, port uint16, opts ...Option) (conn net.Conn, err error) {
+	if !d.Profile().Supports(FeatureTCP) {
+		return nil, fmt.Errorf("%s does not support TCP", d.Profile().Name())
+	}
+	if ip.To16() == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("Invalid IPv6 address: %s", ip)
+	}
+	c := &tcpConn{
+		d:      d,
+		raddr:  &net.TCPAddr{IP: ip, Port: int(port)},
+		laddr:  &net.TCPAddr{Port: int(d.nextTCPPort())},
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	// 接続直後に届くデータを取りこぼさないよう、SKCONNECTの前に購読する
+	c.cancel = d.subscribe(c.match, c.receive)
+
+	callback := func(line string) (bool, error) {
+		if !strings.HasPrefix(line, "ETCP ") {
+			return false, nil
+		}
+		ev, err := parseTCPEvent(line)
+		if err != nil {
+			return false, err
+		}
+		switch ev.Status {
+		case tcpStatusConnected:
+			if ev.IPAddr.Equal(ip) && ev.RPort == port && int(ev.LPort) == c.laddr.Port {
+				c.mu.Lock()
+				c.handle = ev.Handle
+				c.mu.Unlock()
+				d.setTCPHandle(ev.Handle, true)
+				return true, nil
+			}
+		case tcpStatusClosed:
+			// ハンドルはETCP 1で初めて決まるので、接続中に届いた切断は全て他の接続のもの
+			return false, nil
+		case tcpStatusFailed:
+			// 他の宛先への接続失敗や、確立済みの接続のハンドルへの通知は無視する
+			if ev.IPAddr != nil {
+				if !ev.IPAddr.Equal(ip) || ev.RPort != port || int(ev.LPort) != c.laddr.Port {
+					return false, nil
+				}
+			} else if d.tcpHandleInUse(ev.Handle) {
+				return false, nil
+			}
+			return false, fmt.Errorf("TCP connection failed (%s)", line)
+		}
+		return false, nil
+	}
+	cmd := fmt.Sprintf("SKCONNECT %s %04X %04X", formatIPv6(ip), port, c.laddr.Port)
+	connectOpts := append([]Option{Reader(callback)}, opts...)
+	if _, err = d.QuerySKCommandContext(ctx, cmd, connectOpts...); err != nil {
+		c.cancel()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *tcpConn) match(v interface{}) bool {
+	switch v := v.(type) {
+	case tcpSegment:
+		return v.Src.Equal(c.raddr.IP) && int(v.SrcPort) == c.raddr.Port && int(v.DstPort) == c.laddr.Port
+	case tcpEvent:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return v.Status == tcpStatusClosed && c.handle != 0 && v.Handle == c.handle
+	}
+	return false
+}
+
+func (c *tcpConn) receive(v interface{}) {
+	c.mu.Lock()
+	switch v := v.(type) {
+	case tcpSegment:
+		c.buf.Write(v.Data)
+	case tcpEvent:
+		c.eof = true
+		c.d.setTCPHandle(v.Handle, false)
+	}
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *tcpConn) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *tcpConn) Read(b []byte) (n int, err error) {
+	for {
+		c.mu.Lock()
+		if c.buf.Len() > 0 {
+			n, err = c.buf.Read(b)
+			c.mu.Unlock()
+			return
+		}
+		eof, deadline := c.eof, c.readDeadline
+		c.mu.Unlock()
+
+		select {
+		case <-c.closed:
+			return 0, ErrClosed
+		default:
+		}
+		if eof {
+			return 0, io.EOF
+		}
+		var tm *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, tcpTimeoutError{}
+			}
+			tm = time.NewTimer(d)
+			timeout = tm.C
+		}
+		select {
+		case <-c.wake:
+		case <-timeout:
+		case <-c.closed:
+		case <-c.d.closed:
+			err = ErrClosed
+		}
+		if tm != nil {
+			tm.Stop()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *tcpConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	handle, eof, deadline := c.handle, c.eof, c.writeDeadline
+	c.mu.Unlock()
+	if eof {
+		return 0, io.ErrClosedPipe
+	}
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	callback := func(line string) (bool, error) {
+		if !strings.HasPrefix(line, "ETCP ") {
+			return false, nil
+		}
+		ev, err := parseTCPEvent(line)
+		if err != nil || ev.Handle != handle {
+			return false, err
+		}
+		switch ev.Status {
+		case tcpStatusSent:
+			if ev.Result != 0 {
+				return false, fmt.Errorf("Failed to send TCP data (%s)", line)
+			}
+			return true, nil
+		case tcpStatusClosed:
+			return false, io.ErrClosedPipe
+		}
+		return false, nil
+	}
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > maxTCPSendLen {
+			chunk = chunk[:maxTCPSendLen]
+		}
+		cmd := fmt.Sprintf("SKSEND %d %04X %s", handle, len(chunk), chunk)
+		if _, err = c.d.QuerySKCommandContext(ctx, cmd, Reader(callback)); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = tcpTimeoutError{}
+			}
+			return
+		}
+		n += len(chunk)
+	}
+	return
+}
+
+// Close はSKCLOSEで接続を切断する。相手から切断済みならコマンドは送らない
+func (c *tcpConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		handle, eof := c.handle, c.eof
+		c.mu.Unlock()
+		if !eof {
+			callback := func(line string) (bool, error) {
+				if strings.HasPrefix(line, "ETCP ") {
+					ev, err := parseTCPEvent(line)
+					if err == nil && ev.Status == tcpStatusClosed && ev.Handle == handle {
+						return true, nil
+					}
+				}
+				return false, nil
+			}
+			_, err = c.d.QuerySKCommandContext(context.Background(), fmt.Sprintf("SKCLOSE %d", handle), Reader(callback))
+		}
+		c.d.setTCPHandle(handle, false)
+		c.cancel()
+		close(c.closed)
+	})
+	return
+}
+
+func (c *tcpConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *tcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.notify()
+	return nil
+}
+
+func (c *tcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
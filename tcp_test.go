@@ -0,0 +1,155 @@
+package smartmeter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hnw/go-smartmeter/sktest"
+)
+
+func TestDialTCP(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	ip := net.ParseIP(m.Meter.IPAddr())
+
+	if _, err := dev.DialTCP(context.Background(), ip, 80); err == nil {
+		t.Errorf("DialTCP() to closed port should fail")
+	}
+
+	conn, err := dev.DialTCP(context.Background(), ip, 7)
+	if err != nil {
+		t.Fatalf("DialTCP() error: %v", err)
+	}
+	if conn.RemoteAddr().String() != "[fe80::21c:6400:30c:12a4]:7" {
+		t.Errorf("RemoteAddr() differ: %s", conn.RemoteAddr())
+	}
+
+	// SKSEND 1回の上限を超えるデータも分割して送られる
+	msg := strings.Repeat("hello ", 300)
+	if n, err := conn.Write([]byte(msg)); err != nil || n != len(msg) {
+		t.Fatalf("Write() error: %d, %v", n, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if string(buf) != msg {
+		t.Errorf("Echoed data differ")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	var netErr net.Error
+	if _, err := conn.Read(buf); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Read() should time out: %v", err)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Errorf("Write() after Close() should fail")
+	}
+}
+
+func TestDialTCPRemoteClose(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+
+	conn, err := dev.DialTCP(context.Background(), net.ParseIP(m.Meter.IPAddr()), 7)
+	if err != nil {
+		t.Fatalf("DialTCP() error: %v", err)
+	}
+	m.CloseTCP()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() after remote close should return io.EOF: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close() after remote close error: %v", err)
+	}
+	if n := countCommand(m, "SKCLOSE"); n != 0 {
+		t.Errorf("SKCLOSE should not be sent after remote close: %d", n)
+	}
+}
+
+func TestDialTCPWhileOtherConnCloses(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+	if err := dev.Authenticate(); err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	ip := net.ParseIP(m.Meter.IPAddr())
+
+	conn1, err := dev.DialTCP(context.Background(), ip, 7)
+	if err != nil {
+		t.Fatalf("DialTCP() error: %v", err)
+	}
+	// 2つ目の接続中に1つ目の接続が切断される
+	m.Inject(sktest.Fault{Command: "SKCONNECT", Lines: []string{
+		"OK",
+		"ETCP 3 01",
+		"ETCP 1 02 " + m.Meter.IPAddr() + " 0007 C001",
+	}})
+	conn2, err := dev.DialTCP(context.Background(), ip, 7)
+	if err != nil {
+		t.Fatalf("DialTCP() should ignore ETCP 3 for other handle: %v", err)
+	}
+	defer conn2.Close()
+	conn1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn1.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() after remote close should return io.EOF: %v", err)
+	}
+
+	// 他の宛先への接続失敗も無視する
+	m.Inject(sktest.Fault{Command: "SKCONNECT", Lines: []string{
+		"OK",
+		"ETCP 4 03 " + m.Meter.IPAddr() + " 0050 C0FF",
+		"ETCP 1 03 " + m.Meter.IPAddr() + " 0007 C002",
+	}})
+	conn3, err := dev.DialTCP(context.Background(), ip, 7)
+	if err != nil {
+		t.Fatalf("DialTCP() should ignore ETCP 4 for other ports: %v", err)
+	}
+	defer conn3.Close()
+}
+
+func TestTCPPortTable(t *testing.T) {
+	m := sktest.NewModule()
+	m.DualStack = true
+	m.Meter = sktest.NewMeter()
+	defer m.Close()
+	dev := newTestDevice(t, m)
+
+	if _, err := dev.QuerySKCommand("SKTCPPORT 2 0050"); err != nil {
+		t.Fatalf("SKTCPPORT error: %v", err)
+	}
+	ports, err := dev.PortTable()
+	if err != nil {
+		t.Fatalf("PortTable() error: %v", err)
+	}
+	if !reflect.DeepEqual(ports.TCP, []uint16{0, 80, 0, 0}) {
+		t.Errorf("TCP ports differ: %v", ports.TCP)
+	}
+}
@@ -0,0 +1,270 @@
+package smartmeter
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UDPPacket はERXUDPで受信したUDPパケットに対応する構造体
+type UDPPacket struct {
+	Src     net.IP           // 送信元IPv6アドレス
+	Dst     net.IP           // 送信先IPv6アドレス
+	SrcPort uint16           // 送信元ポート番号
+	DstPort uint16           // 送信先ポート番号
+	SrcMAC  net.HardwareAddr // 送信元MACアドレス（64bit）
+	Secured bool             // MAC層で暗号化されていたか
+	Side    int              // 受信したインターフェース（0: Bルート, 1: HAN）
+	LQI     int              // 受信ED値。HasLQIがfalseなら0
+	HasLQI  bool             // ERXUDPにLQIが含まれていたか（デュアルスタックモジュールなど）
+	Time    time.Time        // 受信した時刻
+	Data    []byte           // UDPペイロード
+}
+
+// RSSI はLQIから換算した受信信号強度[dBm]を返す。HasLQIがfalseなら意味を持たない
+func (p *UDPPacket) RSSI() float64 {
+	return lqiToRSSI(p.LQI)
+}
+
+// udpHeaderFields はERXUDPの<SENDERLLA>の次のフィールドから、<DATALEN>までのフィールド数を返す
+// デュアルスタックモジュールでは<SIDE>が付き、ファームウェアによっては<LQI>も付く
+// <LQI>は16進2桁、<SECURED>は1桁なので長さで区別できる
+func udpHeaderFields(next string, dual bool) (n int, hasLQI bool) {
+	if !dual {
+		return 8, false
+	}
+	if len(next) == 2 {
+		return 10, true
+	}
+	return 9, false
+}
+
+// parseUDPPacket はERXUDPイベント行を受け取ってUDPPacketを返す。<DATA>はmodeの表示形式で解釈する
+// dualがtrueならデュアルスタックモジュールの書式（<SIDE>と省略可能な<LQI>が付く）として解釈する
+// 書式: ERXUDP <SENDER> <DEST> <RPORT> <LPORT> <SENDERLLA> [<LQI>] <SECURED> [<SIDE>] <DATALEN> <DATA>
+func parseUDPPacket(line string, mode DisplayMode, dual bool) (p *UDPPacket, err error) {
+	fields := strings.SplitN(line, " ", 8)
+	if len(fields) < 8 || fields[0] != "ERXUDP" {
+		err = fmt.Errorf("Unknown ERXUDP format: %s", line)
+		return
+	}
+	n, hasLQI := udpHeaderFields(fields[6], dual)
+	n++
+	if fields = strings.SplitN(line, " ", n); len(fields) < n {
+		err = fmt.Errorf("Unknown ERXUDP format: %s", line)
+		return
+	}
+	p = &UDPPacket{
+		Src:  net.ParseIP(fields[1]),
+		Dst:  net.ParseIP(fields[2]),
+		Time: time.Now(),
+	}
+	if p.Src == nil || p.Dst == nil {
+		return nil, errors.New("ERXUDP parse error (invalid address) : " + line)
+	}
+	rport, err1 := strconv.ParseUint(fields[3], 16, 16)
+	lport, err2 := strconv.ParseUint(fields[4], 16, 16)
+	mac, err3 := hex.DecodeString(fields[5])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, errors.New("ERXUDP parse error (not a hexadecimal) : " + line)
+	}
+	p.SrcPort = uint16(rport)
+	p.DstPort = uint16(lport)
+	p.SrcMAC = net.HardwareAddr(mac)
+
+	flags := fields[6 : n-2]
+	if hasLQI {
+		lqi, err := strconv.ParseUint(flags[0], 16, 8)
+		if err != nil {
+			return nil, errors.New("ERXUDP parse error (not a hexadecimal) : " + line)
+		}
+		p.LQI = int(lqi)
+		p.HasLQI = true
+		flags = flags[1:]
+	}
+	if dual {
+		if len(flags[1]) != 1 {
+			return nil, fmt.Errorf("Unknown ERXUDP format: %s", line)
+		}
+		if p.Side, err = strconv.Atoi(flags[1]); err != nil {
+			return nil, errors.New("ERXUDP parse error (not a number) : " + line)
+		}
+	}
+	p.Secured = flags[0] == "1"
+
+	dataLen, err := strconv.ParseUint(fields[n-2], 16, 16)
+	if err != nil || len(fields[n-2]) != 4 {
+		return nil, errors.New("ERXUDP parse error (not a number) : " + line)
+	}
+	if p.Data, err = decodeData(fields[n-1], int(dataLen), mode); err != nil {
+		return nil, fmt.Errorf("ERXUDP parse error (%v) : %s", err, line)
+	}
+	return
+}
+
+// echonetLiteHandle はECHONET Lite（ポート3610）に割り当てられたUDPハンドル
+const echonetLiteHandle = 1
+
+// maxUDPHandle はSKUDPPORTで指定できるUDPハンドルの最大値
+const maxUDPHandle = 6
+
+// sendToCommand はModuleProfileの書式でSKSENDTOコマンドを作る
+func sendToCommand(p ModuleProfile, handle int, ipAddr string, port uint16, secured bool, side int, data []byte) string {
+	sec := 0
+	if secured {
+		sec = 1
+	}
+	return p.SendToCommand(handle, ipAddr, port, sec, side, data)
+}
+
+// udpSentError はSKSENDTOの後に受け取ったEVENTを送信失敗のエラーに変換する
+func udpSentError(ev Event) error {
+	if ev.Code == EventTransmitLimitActivated {
+		return ErrTransmitLimited
+	} else if ev.Code == EventUDPSent {
+		switch ev.Param {
+		case 0x01:
+			// 01: UDP送信失敗
+			return fmt.Errorf("Failed to send UDP packet (EVENT 21/01). %w", RetryableError)
+		case 0x02:
+			// 02: アドレス要請
+			return fmt.Errorf("PANA unconnected (EVENT 21/02). %w", ErrNotJoined)
+		}
+	}
+	return nil
+}
+
+func (d *Device) SendUDP(handle int, dst net.IP, port uint16, secured bool, side int, payload []byte, opts ...Option) (err error) {
+	return d.SendUDPContext(context.Background(), handle, dst, port, secured, side, payload, opts...)
+}
+
+// SendUDPContext は任意のUDPハンドルから任意の宛先にUDPパケットを送る（SKSENDTO）
+// sideはFeatureHANに対応したモジュールでのみ有効（0: Bルート, 1: HAN）。EVENT 21とOKで送信完了を確認して返る
+// 応答を受け取るにはReceiveUDP()かOnUDP()を使う
+func (d *Device) SendUDPContext(ctx context.Context, handle int, dst net.IP, port uint16, secured bool, side int, payload []byte, opts ...Option) (err error) {
+	if handle < 1 || handle > maxUDPHandle {
+		return fmt.Errorf("UDP handle must be 1-%d: %d", maxUDPHandle, handle)
+	}
+	if dst.To16() == nil || dst.To4() != nil {
+		return fmt.Errorf("Invalid IPv6 address: %s", dst)
+	}
+	if side != 0 && (side != 1 || !d.Profile().Supports(FeatureHAN)) {
+		return fmt.Errorf("Invalid side: %d", side)
+	}
+	if err = d.waitTransmitLimit(ctx); err != nil {
+		return
+	}
+	profile := d.Profile()
+	cmd := sendToCommand(profile, handle, formatIPv6(dst), port, secured, side, payload)
+
+	// EVENT 21の後にOKが来るので、両方を読み終えるまで次のクエリに行を渡さない
+	var sent, ok bool
+	callback := func(line string) (bool, error) {
+		if ev, isEvent := d.lineEvent(line); isEvent {
+			if err := udpSentError(ev); err != nil {
+				return false, err
+			}
+			if ev.Code == EventUDPSent {
+				sent = true
+			}
+		} else if line == "OK" {
+			ok = true
+		}
+		return sent && ok, nil
+	}
+	sendOpts := append([]Option{Reader(callback)}, opts...)
+	_, err = d.QuerySKCommandContext(ctx, cmd, sendOpts...)
+	if d.fallbackProfile(profile, err) {
+		cmd = sendToCommand(d.Profile(), handle, formatIPv6(dst), port, secured, side, payload)
+		_, err = d.QuerySKCommandContext(ctx, cmd, sendOpts...)
+	}
+	err = d.sendToError(ctx, err, opts...)
+	return
+}
+
+func (d *Device) OpenUDPHandle(port uint16, opts ...Option) (handle int, err error) {
+	return d.OpenUDPHandleContext(context.Background(), port, opts...)
+}
+
+// OpenUDPHandleContext は空いているUDPハンドルに待ち受けポートを割り当てて（SKUDPPORT）、そのハンドルを返す
+// 既に同じポートを待ち受けているハンドルがあればそれを返す
+func (d *Device) OpenUDPHandleContext(ctx context.Context, port uint16, opts ...Option) (handle int, err error) {
+	if port == 0 {
+		return 0, errors.New("UDP port must not be 0")
+	}
+	ports, err := d.PortTableContext(ctx, opts...)
+	if err != nil {
+		return
+	}
+	for i, p := range ports.UDP {
+		if p == port {
+			return i + 1, nil
+		}
+		if p == 0 && handle == 0 {
+			handle = i + 1
+		}
+	}
+	if handle == 0 {
+		return 0, errors.New("No UDP handle is available")
+	}
+	_, err = d.QuerySKCommandContext(ctx, fmt.Sprintf("SKUDPPORT %d %04X", handle, port), opts...)
+	if err != nil {
+		handle = 0
+	}
+	return
+}
+
+func (d *Device) CloseUDPHandle(handle int, opts ...Option) (err error) {
+	return d.CloseUDPHandleContext(context.Background(), handle, opts...)
+}
+
+// CloseUDPHandleContext はUDPハンドルの待ち受けポートを解除する（SKUDPPORT <HANDLE> 0）
+// ECHONET Lite用のハンドル1を閉じるとQueryEchonetLite()が使えなくなる
+func (d *Device) CloseUDPHandleContext(ctx context.Context, handle int, opts ...Option) (err error) {
+	if handle < 1 || handle > maxUDPHandle {
+		return fmt.Errorf("UDP handle must be 1-%d: %d", maxUDPHandle, handle)
+	}
+	_, err = d.QuerySKCommandContext(ctx, fmt.Sprintf("SKUDPPORT %d 0000", handle), opts...)
+	return
+}
+
+// ReceiveUDP はERXUDPで受信した全てのUDPパケットを流すチャンネルを返す
+// ctxが終了するかDeviceがClose()されるとチャンネルは閉じられる
+// 読み出しが追いつかない場合、新しく受信したパケットを取りこぼす
+func (d *Device) ReceiveUDP(ctx context.Context) <-chan UDPPacket {
+	in := make(chan UDPPacket, 16)
+	out := make(chan UDPPacket)
+	cancel := d.OnUDP(func(p UDPPacket) {
+		select {
+		case in <- p:
+		default:
+			d.warnf("UDP receiver is too slow. Dropped: %+v", p)
+		}
+	})
+	go func() {
+		defer close(out)
+		defer cancel()
+		for {
+			select {
+			case p := <-in:
+				select {
+				case out <- p:
+				case <-ctx.Done():
+					return
+				case <-d.closed:
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-d.closed:
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,94 @@
+package smartmeter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUDPPacket(t *testing.T) {
+	tests := []struct {
+		line string
+		mode DisplayMode
+		dual bool
+	}{
+		// Bルート専用モジュール
+		{"ERXUDP FE80:0000:0000:0000:021C:6400:030C:12A4 FE80:0000:0000:0000:021D:1290:1234:5678 0E1A 0E1A 001C6400030C12A4 1 0004 0102030A", DisplayASCII, false},
+		// デュアルスタックモジュール（LQIとSIDE付き）
+		{"ERXUDP FE80:0000:0000:0000:021C:6400:030C:12A4 FE80:0000:0000:0000:021D:1290:1234:5678 0E1A 0E1A 001C6400030C12A4 E1 1 0 0004 0102030A", DisplayASCII, true},
+		// デュアルスタックモジュール（LQIなし）
+		{"ERXUDP FE80:0000:0000:0000:021C:6400:030C:12A4 FE80:0000:0000:0000:021D:1290:1234:5678 0E1A 0E1A 001C6400030C12A4 1 0 0004 0102030A", DisplayASCII, true},
+		{"ERXUDP FE80:0000:0000:0000:021C:6400:030C:12A4 FE80:0000:0000:0000:021D:1290:1234:5678 0E1A 0E1A 001C6400030C12A4 1 0 0004 \x01\x02\x03\x0A", DisplayBinary, true},
+		// バイナリ表示
+		{"ERXUDP FE80:0000:0000:0000:021C:6400:030C:12A4 FE80:0000:0000:0000:021D:1290:1234:5678 0E1A 0E1A 001C6400030C12A4 1 0004 \x01\x02\x03\x0A", DisplayBinary, false},
+	}
+	for _, tt := range tests {
+		p, err := parseUDPPacket(tt.line, tt.mode, tt.dual)
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+		if p.SrcPort != 0x0E1A || p.DstPort != 0x0E1A {
+			t.Errorf("Port differ: %d, %d", p.SrcPort, p.DstPort)
+		}
+		if p.Src.String() != "fe80::21c:6400:30c:12a4" {
+			t.Errorf("Source address differ: %v", p.Src)
+		}
+		if p.SrcMAC.String() != "00:1c:64:00:03:0c:12:a4" {
+			t.Errorf("Source MAC address differ: %v", p.SrcMAC)
+		}
+		if !p.Secured {
+			t.Errorf("Secured flag differ: %v", p.Secured)
+		}
+		if !reflect.DeepEqual(p.Data, []byte{1, 2, 3, 10}) {
+			t.Errorf("Data differ: %v", p.Data)
+		}
+	}
+
+	p, err := parseUDPPacket(tests[1].line, DisplayASCII, true)
+	if err != nil || !p.HasLQI || p.LQI != 0xE1 || p.Side != 0 {
+		t.Errorf("LQI is not parsed: %+v, %v", p, err)
+	}
+	if p, _ := parseUDPPacket(tests[0].line, DisplayASCII, false); p.HasLQI {
+		t.Errorf("HasLQI should be false without LQI: %+v", p)
+	}
+	if p, _ := parseUDPPacket(tests[2].line, DisplayASCII, true); p.HasLQI || p.Side != 0 {
+		t.Errorf("HasLQI should be false without LQI: %+v", p)
+	}
+
+	// 表示形式や書式と合わないデータは推測せずにエラーにする
+	if _, err := parseUDPPacket(tests[0].line, DisplayBinary, false); err == nil {
+		t.Errorf("parseUDPPacket() should fail for hex data in binary mode")
+	}
+	if _, err := parseUDPPacket(tests[1].line, DisplayASCII, false); err == nil {
+		t.Errorf("parseUDPPacket() should fail for dual stack line with single stack layout")
+	}
+	if _, err := parseUDPPacket(tests[0].line, DisplayASCII, true); err == nil {
+		t.Errorf("parseUDPPacket() should fail for single stack line with dual stack layout")
+	}
+	if _, err := parseUDPPacket("ERXUDP FE80:0000:0000:0000:021C:6400:030C:12A4", DisplayASCII, false); err == nil {
+		t.Errorf("parseUDPPacket() should fail for truncated line")
+	}
+}
+
+func TestBinaryDataLen(t *testing.T) {
+	const prefix = "ERXUDP FE80:0000:0000:0000:021C:6400:030C:12A4 FE80:0000:0000:0000:021D:1290:1234:5678 0E1A 0E1A 001C6400030C12A4 "
+	tests := []struct {
+		header string
+		dual   bool
+		n      int
+		ok     bool
+	}{
+		{prefix + "1 0004 ", false, 4, true},
+		{prefix + "E1 1 0 0004 ", true, 4, true},
+		{prefix + "1 0 0004 ", true, 4, true},
+		// <DATALEN>まで読んでいない
+		{prefix + "E1 1 0 ", true, 0, false},
+		{prefix + "1 0 ", true, 0, false},
+		{"ERXTCP FE80:0000:0000:0000:021C:6400:030C:12A4 0007 C000 0010 ", false, 16, true},
+	}
+	for _, tt := range tests {
+		n, ok := binaryDataLen(tt.header, tt.dual)
+		if n != tt.n || ok != tt.ok {
+			t.Errorf("binaryDataLen(%q, %v) differ: %d, %v != %d, %v", tt.header, tt.dual, n, ok, tt.n, tt.ok)
+		}
+	}
+}